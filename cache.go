@@ -0,0 +1,217 @@
+package renders
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// templateCacheVersion changes whenever the cache file layout or the way
+// sources are prepared changes, older cache files are then ignored
+const templateCacheVersion = 2
+
+// templateCache is what Options.CacheFile holds: the prepared sources of
+// every registered template and the files they were read from
+type templateCache struct {
+	Version int
+	// Options the prepared sources depend on
+	Key string
+	// modification times of every walked template file
+	Files map[string]time.Time
+	// modification times of included files outside the walked ones
+	Includes map[string]time.Time
+	// SHA-256 of the files above read from a FileSystem or without a
+	// modification time, an embed.FS has none and a rebuilt binary with
+	// edited templates would pass the checks above
+	Hashes    map[string]string
+	Templates []cachedTemplate
+}
+
+type cachedTemplate struct {
+	// Name the template is registered by
+	Name string
+	// Sources are the sources parsed together, the loaded file first, with
+	// includes resolved and defines invalidated
+	Sources []namedTemplate
+	// Meta is the front matter as YAML, empty when there was none
+	Meta string
+}
+
+// cacheKey describes the options the prepared sources depend on. Funcs like
+// Preprocess and NameFunc can't be compared, the cache file has to be removed
+// when they change.
+func (l *loader) cacheKey() string {
+	return fmt.Sprintf("%q %q %q %q %t %t %t", l.dirs, l.exts, l.leftDelim, l.rightDelim, l.frontMatter, l.text, l.caseInsensitive)
+}
+
+// cachedTemplate returns the registered template being loaded, ready to be
+// written to the cache file
+func (l *loader) cachedTemplate(name string) (cachedTemplate, error) {
+	ct := cachedTemplate{Name: name, Sources: make([]namedTemplate, len(l.cache))}
+	for i, nt := range l.cache {
+		ct.Sources[i] = *nt
+	}
+	if l.pageMeta != nil {
+		meta, err := yaml.Marshal(l.pageMeta)
+		if err != nil {
+			return ct, err
+		}
+		ct.Meta = string(meta)
+	}
+	return ct, nil
+}
+
+// loadCache parses the templates of the cache file, ok is false when there
+// is no usable cache file or any template file changed since it was written
+func (l *loader) loadCache(funcMap template.FuncMap) (templates map[string]engineTemplate, ok bool, err error) {
+	b, err := ioutil.ReadFile(l.cacheFile)
+	if err != nil {
+		return nil, false, nil
+	}
+	var c templateCache
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&c); err != nil {
+		return nil, false, nil
+	}
+	if c.Version != templateCacheVersion || c.Key != l.cacheKey() {
+		return nil, false, nil
+	}
+	l.modTimes = c.Files
+	if l.changed() {
+		return nil, false, nil
+	}
+	for path, mt := range c.Includes {
+		if fi, err := l.stat(path); err != nil || !fi.ModTime().Equal(mt) {
+			return nil, false, nil
+		}
+	}
+	for path, h := range c.Hashes {
+		if sum, err := l.hash(path); err != nil || sum != h {
+			return nil, false, nil
+		}
+	}
+
+	templates = make(map[string]engineTemplate, len(c.Templates))
+	refs := newTemplateRefs()
+	for _, ct := range c.Templates {
+		l.cache = l.cache[0:0]
+		for i := range ct.Sources {
+			l.cache = append(l.cache, &ct.Sources[i])
+		}
+		t, err := l.parse(funcMap)
+		if err != nil {
+			return nil, false, nil
+		}
+		if l.strictPartials {
+			l.collectReferences(t, refs)
+		}
+		templates[ct.Name] = t
+		if len(ct.Meta) > 0 {
+			meta := make(map[string]interface{})
+			if err := yaml.Unmarshal([]byte(ct.Meta), &meta); err != nil {
+				return nil, false, nil
+			}
+			l.meta[ct.Name] = meta
+		}
+	}
+	l.cache = l.cache[0:0]
+
+	if dangling := refs.dangling(func(name string) bool {
+		_, ok := templates[name]
+		return ok
+	}); len(dangling) > 0 {
+		err = fmt.Errorf("render: unresolved template references:\n\t%s", strings.Join(dangling, "\n\t"))
+	}
+	return templates, true, err
+}
+
+// saveCache writes the templates of a successful run to the cache file. The
+// file is replaced at once, so a concurrent start never reads half of it.
+func (l *loader) saveCache(templates []cachedTemplate) error {
+	c := templateCache{
+		Version:   templateCacheVersion,
+		Key:       l.cacheKey(),
+		Files:     l.modTimes,
+		Includes:  make(map[string]time.Time),
+		Hashes:    make(map[string]string),
+		Templates: templates,
+	}
+	for _, ct := range templates {
+		for _, nt := range ct.Sources {
+			if _, ok := l.modTimes[nt.Path]; ok {
+				continue
+			}
+			fi, err := l.stat(nt.Path)
+			if err != nil {
+				return err
+			}
+			c.Includes[nt.Path] = fi.ModTime()
+		}
+	}
+	for _, files := range []map[string]time.Time{c.Files, c.Includes} {
+		for path, mt := range files {
+			if l.fsys == nil && !mt.IsZero() {
+				continue
+			}
+			sum, err := l.hash(path)
+			if err != nil {
+				return err
+			}
+			c.Hashes[path] = sum
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&c); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(l.cacheFile), filepath.Base(l.cacheFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.cacheFile)
+}
+
+// stat returns the FileInfo of the template file at path
+func (l *loader) stat(path string) (os.FileInfo, error) {
+	if l.fsys != nil {
+		return fs.Stat(l.fsys, path)
+	}
+	return os.Stat(path)
+}
+
+// hash returns the hex encoded SHA-256 of the template file at path
+func (l *loader) hash(path string) (string, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if l.fsys != nil {
+		b, err = fs.ReadFile(l.fsys, path)
+	} else {
+		b, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,22 @@
+package renders
+
+import (
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCacheFileFileSystemEdited(t *testing.T) {
+	cache := filepath.Join(t.TempDir(), "templates.cache")
+	for _, src := range []string{"OLD", "NEW", "NEW"} {
+		fsys := fstest.MapFS{
+			"a.html":     {Data: []byte(src + `{{ template "b.html" }}`)},
+			"b.html":     {Data: []byte(src)},
+			"sub/c.html": {Data: []byte(src)},
+		}
+		r, _ := testRenderer(t, Options{FileSystem: fsys, Directory: ".", CacheFile: cache})
+		if out, err := r.HTMLString("a.html", nil); err != nil || out != src+src {
+			t.Errorf("%s: %q, %v", src, out, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package renders
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+)
+
+const headerCSP = "Content-Security-Policy"
+
+// cspNonce returns the nonce of the request, generated once. URL safe
+// base64 is valid in CSP and is written to attributes without escaping.
+func (r *renderer) cspNonce() (string, error) {
+	r.nonceOnce.Do(func() {
+		b := make([]byte, 16)
+		if _, r.nonceErr = rand.Read(b); r.nonceErr == nil {
+			r.nonce = base64.RawURLEncoding.EncodeToString(b)
+		}
+	})
+	return r.nonce, r.nonceErr
+}
+
+// bindNonce makes the nonce of the request available to its templates as
+// cspNonce when Options.CSPNonce is set
+func (r *renderer) bindNonce() {
+	if !r.opt.CSPNonce {
+		return
+	}
+	r.nonceBound.Do(func() {
+		r.AddFunc("cspNonce", r.cspNonce)
+	})
+}
+
+// setNonceHeader adds the nonce of the request to the script-src directive
+// of the Content-Security-Policy header. Without script-src, scripts follow
+// default-src, so its sources are carried over into the new directive.
+func (r *renderer) setNonceHeader() {
+	if !r.opt.CSPNonce {
+		return
+	}
+	nonce, err := r.cspNonce()
+	if err != nil {
+		return
+	}
+	r.Header().Set(headerCSP, addNonce(r.Header().Get(headerCSP), nonce))
+}
+
+// addNonce returns policy with nonce added to its script-src directive, a
+// policy that already holds it is returned unchanged
+func addNonce(policy, nonce string) string {
+	source := "'nonce-" + nonce + "'"
+	if strings.Contains(policy, source) {
+		return policy
+	}
+	var (
+		directives []string
+		defaultSrc []string
+		found      bool
+	)
+	for _, d := range strings.Split(policy, ";") {
+		fields := strings.Fields(d)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToLower(fields[0]) {
+		case "script-src":
+			fields = append(withoutNone(fields), source)
+			found = true
+		case "default-src":
+			defaultSrc = fields[1:]
+		}
+		directives = append(directives, strings.Join(fields, " "))
+	}
+	if !found {
+		fields := append(withoutNone(append([]string{"script-src"}, defaultSrc...)), source)
+		directives = append(directives, strings.Join(fields, " "))
+	}
+	return strings.Join(directives, "; ")
+}
+
+// withoutNone drops 'none', which is only valid as the single source
+func withoutNone(fields []string) []string {
+	kept := fields[:0:0]
+	for _, f := range fields {
+		if !strings.EqualFold(f, "'none'") {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
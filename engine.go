@@ -0,0 +1,161 @@
+package renders
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"regexp"
+	"strconv"
+	texttemplate "text/template"
+)
+
+// engineTemplate hides whether a template was parsed by html/template or by
+// text/template, their templates behave alike but don't share a type.
+// Both packages use the same FuncMap type.
+type engineTemplate interface {
+	// Name is the name of the template file, which may differ from the name
+	// it is rendered by when Options.NameFunc is set
+	Name() string
+	ExecuteTemplate(w io.Writer, name string, data interface{}) error
+	// Clone returns a copy which can get its own funcs
+	Clone() (engineTemplate, error)
+	Funcs(funcMap template.FuncMap) engineTemplate
+	// Defines reports whether a template of that name is associated
+	Defines(name string) bool
+}
+
+// htmlTemplate is an engineTemplate with contextual auto-escaping
+type htmlTemplate struct {
+	*template.Template
+}
+
+func (t htmlTemplate) Clone() (engineTemplate, error) {
+	c, err := t.Template.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return htmlTemplate{c}, nil
+}
+
+func (t htmlTemplate) Funcs(funcMap template.FuncMap) engineTemplate {
+	t.Template.Funcs(funcMap)
+	return t
+}
+
+func (t htmlTemplate) Defines(name string) bool {
+	return t.Template.Lookup(name) != nil
+}
+
+// textTemplate is an engineTemplate without any escaping
+type textTemplate struct {
+	*texttemplate.Template
+}
+
+func (t textTemplate) Clone() (engineTemplate, error) {
+	c, err := t.Template.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return textTemplate{c}, nil
+}
+
+func (t textTemplate) Funcs(funcMap template.FuncMap) engineTemplate {
+	t.Template.Funcs(funcMap)
+	return t
+}
+
+func (t textTemplate) Defines(name string) bool {
+	return t.Template.Lookup(name) != nil
+}
+
+// parse parses the cached sources into one template namespace named after
+// the first of them, which is the file being loaded
+func (l *loader) parse(funcMap template.FuncMap) (engineTemplate, error) {
+	if l.text {
+		return l.parseText(funcMap)
+	}
+	return l.parseHTML(funcMap)
+}
+
+func (l *loader) parseHTML(funcMap template.FuncMap) (engineTemplate, error) {
+	var baseTmpl *template.Template
+	for i, nt := range l.cache {
+		var currentTmpl *template.Template
+		if i == 0 {
+			baseTmpl = template.New(nt.Name)
+			currentTmpl = baseTmpl
+		} else {
+			currentTmpl = baseTmpl.New(nt.Name)
+		}
+
+		if _, err := currentTmpl.Delims(l.leftDelim, l.rightDelim).Funcs(layoutFuncs).Funcs(funcMap).Parse(nt.Src); err != nil {
+			return nil, newParseError(nt, err)
+		}
+	}
+	return htmlTemplate{baseTmpl}, nil
+}
+
+func (l *loader) parseText(funcMap template.FuncMap) (engineTemplate, error) {
+	var baseTmpl *texttemplate.Template
+	for i, nt := range l.cache {
+		var currentTmpl *texttemplate.Template
+		if i == 0 {
+			baseTmpl = texttemplate.New(nt.Name)
+			currentTmpl = baseTmpl
+		} else {
+			currentTmpl = baseTmpl.New(nt.Name)
+		}
+
+		if _, err := currentTmpl.Delims(l.leftDelim, l.rightDelim).Funcs(layoutFuncs).Funcs(funcMap).Parse(nt.Src); err != nil {
+			return nil, newParseError(nt, err)
+		}
+	}
+	return textTemplate{baseTmpl}, nil
+}
+
+// Parse errors of text/template look like "template: name:42: unexpected {{end}}",
+// optionally with a column after the line
+var reParseError = regexp.MustCompile(`(?s)^template: [^:]*:(\d+):(?:\d+:)? ?(.*)$`)
+
+// parseError is a template parse error pointing at the file and line it
+// happened in. Every file is parsed on its own with its lines kept as
+// written, so the line reported by the template package is the file's line.
+type parseError struct {
+	path string
+	line int
+	msg  string
+	err  error
+}
+
+func newParseError(nt *namedTemplate, err error) error {
+	m := reParseError.FindStringSubmatch(err.Error())
+	if m == nil {
+		return fmt.Errorf("render: parsing %s: %w", nt.Path, err)
+	}
+	line, _ := strconv.Atoi(m[1])
+	return &parseError{path: nt.Path, line: line, msg: m[2], err: err}
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("render: %s:%d: %s", e.path, e.line, e.msg)
+}
+
+// Unwrap returns the error of the template package
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// htmlTemplates unwraps the templates of an html/template loader for the
+// public Load functions
+func htmlTemplates(t map[string]engineTemplate) map[string]*template.Template {
+	if t == nil {
+		return nil
+	}
+	m := make(map[string]*template.Template, len(t))
+	for name, tmpl := range t {
+		if ht, ok := tmpl.(htmlTemplate); ok {
+			m[name] = ht.Template
+		}
+	}
+	return m
+}
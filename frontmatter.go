@@ -0,0 +1,77 @@
+package renders
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const frontMatterDelim = "---"
+
+// splitFrontMatter parses the YAML block between two --- lines at the start
+// of a template source. The block is replaced by a template comment with the
+// same number of lines, so line numbers of parse errors stay those of the
+// file. A source without front matter is returned unchanged with nil meta.
+func (l *loader) splitFrontMatter(src string) (map[string]interface{}, string, error) {
+	first, rest, ok := cutLine(src)
+	if !ok || first != frontMatterDelim {
+		return nil, src, nil
+	}
+
+	var block []string
+	for {
+		var line string
+		if line, rest, ok = cutLine(rest); !ok && len(line) == 0 {
+			return nil, src, fmt.Errorf("render: front matter is not closed by %s", frontMatterDelim)
+		}
+		if line == frontMatterDelim {
+			break
+		}
+		block = append(block, line)
+	}
+
+	meta := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(strings.Join(block, "\n")), &meta); err != nil {
+		return nil, src, fmt.Errorf("render: parsing front matter: %w", err)
+	}
+
+	// the newlines of the block and of both delimiter lines
+	comment := l.leftDelim + "/*" + strings.Repeat("\n", len(block)+2) + "*/" + l.rightDelim
+	return meta, comment + rest, nil
+}
+
+// cutLine splits off the first line of s, ok is false when s has no newline
+func cutLine(s string) (line, rest string, ok bool) {
+	i := strings.IndexByte(s, '\n')
+	if i < 0 {
+		return s, "", false
+	}
+	return strings.TrimSuffix(s[:i], "\r"), s[i+1:], true
+}
+
+// frontMatterLayout returns the layout a template declares in its front matter
+func frontMatterLayout(meta map[string]interface{}) string {
+	layout, _ := meta["layout"].(string)
+	return layout
+}
+
+// withMeta makes the front matter of the rendered template available as
+// .Meta of map data, keys of the data win
+func withMeta(data interface{}, meta map[string]interface{}) interface{} {
+	switch d := data.(type) {
+	case nil:
+		return map[string]interface{}{"Meta": meta}
+	case map[string]interface{}:
+		if _, ok := d["Meta"]; ok {
+			return data
+		}
+		merged := make(map[string]interface{}, len(d)+1)
+		for k, v := range d {
+			merged[k] = v
+		}
+		merged["Meta"] = meta
+		return merged
+	}
+	return data
+}
@@ -0,0 +1,89 @@
+package renders
+
+import (
+	"net/http"
+	"strings"
+)
+
+// acceptLanguage is the default Options.LocaleFunc, it returns the most
+// preferred language of the Accept-Language header
+func acceptLanguage(req *http.Request) string {
+	for _, ar := range parseAccept(req.Header.Get("Accept-Language")) {
+		if ar.q > 0 && ar.mediaType != "*" {
+			return canonicalLocale(ar.mediaType)
+		}
+	}
+	return ""
+}
+
+// canonicalLocale writes a language tag the way template files are usually
+// named, e.g. "pt-br" becomes "pt-BR"
+func canonicalLocale(locale string) string {
+	parts := strings.Split(locale, "-")
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		if len(parts[i]) == 2 {
+			parts[i] = strings.ToUpper(parts[i])
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// locale returns the locale of the request, computed once. Taken from
+// Accept-Language the response depends on that header, which is added to
+// Vary so shared caches keep the variants apart.
+func (r *renderer) locale() string {
+	r.localeOnce.Do(func() {
+		if r.req == nil {
+			return
+		}
+		if r.opt.LocaleFunc != nil {
+			r.reqLocale = r.opt.LocaleFunc(r.req)
+		} else {
+			r.reqLocale = acceptLanguage(r.req)
+			r.addVary("Accept-Language")
+		}
+	})
+	return r.reqLocale
+}
+
+// bindTranslator makes Options.Translator available to the templates of the
+// request as T, bound to the request locale
+func (r *renderer) bindTranslator() {
+	if r.opt.Translator == nil {
+		return
+	}
+	r.translatorOnce.Do(func() {
+		locale, translate := r.locale(), r.opt.Translator
+		r.AddFunc("T", func(key string, args ...interface{}) string {
+			return translate(locale, key, args...)
+		})
+	})
+}
+
+// compiled returns the template of set registered as name. With
+// LocalizeTemplates a variant for the request locale is preferred, first
+// for the whole locale, then for its language alone.
+func (r *renderer) compiled(set templateSet, name string) *compiledTemplate {
+	if r.opt.CaseInsensitiveNames {
+		// registered lower case, locales included
+		name = strings.ToLower(name)
+	}
+	if r.opt.LocalizeTemplates {
+		locale := r.locale()
+		if r.opt.CaseInsensitiveNames {
+			locale = strings.ToLower(locale)
+		}
+		if len(locale) > 0 {
+			if ct := set[localizedName(name, locale)]; ct != nil {
+				return ct
+			}
+			if i := strings.IndexByte(locale, '-'); i > 0 {
+				if ct := set[localizedName(name, locale[:i])]; ct != nil {
+					return ct
+				}
+			}
+		}
+	}
+	return set[name]
+}
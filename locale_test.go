@@ -0,0 +1,36 @@
+package renders
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLocalizeTemplatesVary(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{
+		"home.html":    `en`,
+		"home.fr.html": `fr`,
+	})
+	fromCookie := func(*http.Request) string { return "fr" }
+
+	tests := []struct {
+		lang       string
+		localeFunc func(*http.Request) string
+		out, vary  string
+	}{
+		{"fr-CH", nil, "fr", "Accept-Language"},
+		{"en", nil, "en", "Accept-Language"},
+		{"", nil, "en", "Accept-Language"},
+		{"en", fromCookie, "fr", ""},
+	}
+	for _, test := range tests {
+		r, rec := testRenderer(t, Options{Directory: dir, LocalizeTemplates: true, LocaleFunc: test.localeFunc})
+		r.req.Header.Set("Accept-Language", test.lang)
+		r.HTML(http.StatusOK, "home.html", nil)
+		if rec.Body.String() != test.out {
+			t.Errorf("%q: body %q, want %q", test.lang, rec.Body, test.out)
+		}
+		if vary := rec.Header().Get("Vary"); vary != test.vary {
+			t.Errorf("%q: Vary %q, want %q", test.lang, vary, test.vary)
+		}
+	}
+}
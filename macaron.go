@@ -2,97 +2,365 @@ package renders
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"html/template"
+	"io"
+	"io/fs"
+	"mime"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
 
 	"fmt"
+	"github.com/BurntSushi/toml"
 	"github.com/oxtoacart/bpool"
 	"gopkg.in/macaron.v1"
-	"time"
+	"gopkg.in/yaml.v2"
 	"log"
-	"io"
+	"sync"
+	"time"
 )
 
 const (
-	ContentType    = "Content-Type"
-	ContentLength  = "Content-Length"
-	ContentBinary  = "application/octet-stream"
-	ContentPlain   = "text/plain"
-	ContentJSON    = "application/json"
-	ContentHTML    = "text/html"
-	ContentXHTML   = "application/xhtml+xml"
-	ContentXML     = "text/xml"
-	defaultCharset = "UTF-8"
+	ContentType     = "Content-Type"
+	ContentLength   = "Content-Length"
+	ContentEncoding = "Content-Encoding"
+	ContentBinary   = "application/octet-stream"
+	ContentPlain    = "text/plain"
+	ContentJSON     = "application/json"
+	ContentJSONP    = "application/javascript"
+	ContentHTML     = "text/html"
+	ContentXHTML    = "application/xhtml+xml"
+	ContentXML      = "text/xml"
+	ContentYAML     = "application/x-yaml"
+	ContentTOML     = "application/toml"
+	ContentCSV      = "text/csv"
+	ContentPDF      = "application/pdf"
+	defaultCharset  = "UTF-8"
 )
 
 const (
 	defaultTplSetName = "DEFAULT"
 )
 
-// Provides a temporary buffer to execute templates into and catch errors.
-var bufpool *bpool.BufferPool
-// key is full path with an extension, e.g layouts/layout.html
-var templates map[string]*template.Template
+// DefaultExtensions are the template file extensions loaded when
+// Options.Extensions is empty. Change it before creating a Renderer.
+var DefaultExtensions = []string{".html"}
+
+// Valid JSONP callback names, anything else could be used to inject script.
+var reJSONPCallback = regexp.MustCompile(`^[a-zA-Z0-9_.]+$`)
+
+var errRenderTimeout = errors.New("render: timed out")
 
 // Options is a struct for specifying configuration options for the render.Renderer middleware
 type Options struct {
 	// Directory to load templates. Default is "templates"
 	Directory string
-	// Extensions to parse template files from. Defaults to [".tmpl"]
+	// Directories to load templates from in order, replaces Directory when set.
+	// A template name found in several directories is taken from the last one.
+	Directories []string
+	// Fail loading when a template name is found in more than one of Directories instead.
+	DuplicateNamesError bool
+	// Preprocess transforms the source of every template file, by its template name, before it is parsed.
+	// An error fails loading.
+	Preprocess func(name, src string) (string, error)
+	// Parse a YAML block between --- lines at the start of template files. A layout key sets the default layout of
+	// that template and the block is available to the render as .Meta when the data is a map or nil.
+	FrontMatter bool
+	// Fail loading when a {{ template }} tag names neither a define of any loaded template nor a template file, listing
+	// every such tag. Default is false which only fails when a template using the tag is rendered.
+	StrictPartials bool
+	// Load empty template files as empty templates, e.g. placeholder partials. Default is false which fails loading
+	// on an empty file.
+	AllowEmptyTemplates bool
+	// NameFunc derives the name a template is rendered by from its slash separated path relative to the directory,
+	// e.g. to strip the extension. Default is nil which uses the path itself, like "users/index.html".
+	NameFunc func(relPath string) string
+	// Register templates by their lower cased name and look them up the same way, so "Home.html" renders home.html.
+	// Names in {{ template }} tags still have to match the file names. Default is false which is case-sensitive.
+	CaseInsensitiveNames bool
+	// Template sets added with SetTemplatePath that are parsed with text/template, so their output isn't escaped.
+	// Only list sets whose templates and data are trusted, the default set is only unescaped with TextMode.
+	UnescapedSets []string
+	// Parse every template set with text/template, for output that isn't HTML like config files or plain text
+	// mails. Nothing is escaped then, and HTMLContentType defaults to text/plain.
+	TextMode bool
+	// Only compile a set added with SetTemplatePath when it is first rendered, once, instead of right away.
+	// A set that fails to compile then fails every render of it with the error, until it is added again.
+	LazySets bool
+	// FileSystem to load templates from, e.g. an embed.FS. Directory is then relative to its root. Default is nil which reads from the disk.
+	FileSystem fs.FS
+	// Descend into symlinked directories of the template directories, skipping links that would loop. Default is
+	// false which, like filepath.Walk, doesn't follow them. Only applies to templates read from the disk.
+	FollowSymlinks bool
+	// CacheFile keeps the prepared template sources between starts, so a start where no template file changed
+	// skips reading and preprocessing them and only parses. Files of a FileSystem, like an embed.FS that keeps no
+	// modification times, are compared by their contents as well. Remove the file when Preprocess or NameFunc
+	// change. Default is "" which caches nothing.
+	CacheFile string
+	// Extensions to parse template files from, "html" is read as ".html". Defaults to DefaultExtensions, [".html"].
 	Extensions []string
+	// Content types of template renders by the extension of the rendered template file, e.g. ".svg" to "image/svg+xml".
+	// The charset is appended the same way as for HTML. Extensions not listed render as HTMLContentType.
+	ExtensionContentType map[string]string
 	// Funcs is a slice of FuncMaps to apply to the template upon compilation. This is useful for helper functions. Defaults to [].
+	// A func that panics fails the render like one returning an error, the template packages recover the panic.
 	Funcs template.FuncMap
-	// Appends the given charset to the Content-Type header. Default is "UTF-8".
+	// Layout used by HTML renders that don't pass one in macaron.HTMLOptions, nested layouts are comma separated.
+	// Default is "" which renders without a layout.
+	Layout string
+	// DataFunc returns values every template of a request can use, like the current user or a CSRF token.
+	// They are merged into map[string]interface{} data, with the keys of the data winning, and become the data
+	// of renders without any. Templates rendering other data reach them with {{ (global).User }}.
+	DataFunc func(req *http.Request) map[string]interface{}
+	// DataValidator checks the data of every template render right before the template executes, with DataFunc
+	// values and .Meta merged in. An error fails the render with a 500 carrying its message.
+	DataValidator func(name string, data interface{}) error
+	// Render the variant of a template for the request locale when there is one, "home.fr.html" or "home.fr"
+	// instead of "home.html" or "home". A locale like "fr-CH" tries "home.fr-CH.html" before "home.fr.html".
+	LocalizeTemplates bool
+	// LocaleFunc returns the locale of a request for LocalizeTemplates and Translator. Default is the first language of
+	// Accept-Language, which is then added to the Vary header of responses that used the locale.
+	LocaleFunc func(req *http.Request) string
+	// Translator is called by {{ T "key" args... }} in templates with the locale of the request from LocaleFunc.
+	// Default is nil which makes T return the key.
+	Translator func(locale, key string, args ...interface{}) string
+	// Left and right delimiters of template actions. Default is "{{" and "}}".
+	LeftDelim  string
+	RightDelim string
+	// Appends the given charset to the Content-Type header. Default is "UTF-8", "-" sends no charset parameter at all.
 	Charset string
 	// Outputs human readable JSON
 	IndentJSON bool
+	// Sends the status and headers of JSON responses before encoding, with a json.Encoder writing into the response.
+	// The renderer sets no Content-Length, ETag or compression, and an encoding error can't become a 500.
+	// encoding/json still builds the whole value in memory before writing it, the memory use is that of the default.
+	StreamJSON bool
+	// TrailerFunc returns trailers sent after a JSON body streamed with StreamJSON, e.g. a row count. It is called once
+	// the body is encoded and not at all for HTTP/1.0 requests.
+	TrailerFunc func() map[string]string
+	// Leave <, > and & in JSON strings as they are instead of escaping them as \u003c, \u003e and \u0026. Only enable it
+	// when no JSON response is ever embedded in HTML.
+	UnescapeHTMLJSON bool
 	// Outputs human readable XML
 	IndentXML bool
+	// Outputs indented TOML tables
+	IndentTOML bool
+	// Indentation used by IndentJSON and IndentXML for each level. Default is two spaces.
+	IndentString string
+	// Prefix of every line after the first one of indented JSON and XML. Default is "".
+	IndentPrefix string
 	// Prefixes the JSON output with the given bytes.
 	PrefixJSON []byte
 	// Prefixes the XML output with the given bytes.
 	PrefixXML []byte
+	// Start JSON, XML, plain text and HTML output in UTF-8 with a byte order mark, for clients that need one. It comes
+	// first, before XMLHeader and PrefixJSON or PrefixXML, and is not part of JSONBytes and XMLBytes.
+	UTF8BOM bool
+	// Start XML output with an <?xml?> declaration whose encoding is Charset, before PrefixXML.
+	XMLHeader bool
+	// Prefixes the YAML output with the given bytes.
+	PrefixYAML []byte
+	// Sets an ETag on every 200 response rendered in full before sending, like JSON, XML, HTML, YAML, CSV, PDF, plain
+	// text and raw data, and answers a matching If-None-Match of a GET or HEAD request with 304 Not Modified. File,
+	// Stream, HTMLStream and StreamJSON responses get none.
+	ETag bool
+	// Gzips the responses ETag covers, of any status, for clients sending a matching Accept-Encoding.
+	Compression bool
+	// Responses shorter than this many bytes are sent uncompressed. Default is 0 which compresses every non-empty body,
+	// empty bodies, 1xx, 204 and 304 responses are never compressed. HEAD gets the headers of the GET.
+	CompressionMinLength int
 	// Allows changing of output to XHTML instead of HTML. Default is "text/html"
 	HTMLContentType string
+	// Templates rendered by Error and by failed renders for a status, with the Status and Message as data.
+	// Statuses without a template get a plain text body.
+	ErrorTemplates map[int]string
+	// Self-close void elements like <br> in HTML output when HTMLContentType is XHTML, which XHTML requires.
+	SelfCloseVoidElements bool
+	// Headers set on every response unless the handler or a middleware already set them, e.g. Vary: Accept-Encoding.
+	// They are added right before the status is written, so a handler can override them by setting the header first.
+	DefaultHeaders map[string]string
+	// Remove HTML comments from the output of HTML renders, conditional comments like <!--[if IE]> are kept
+	// unless StripConditionalComments is set as well.
+	StripComments            bool
+	StripConditionalComments bool
+	// Minify the output of HTML renders, by default collapsing whitespace and dropping comments outside of pre,
+	// textarea, script and style elements.
+	MinifyHTML bool
+	// Minifier replaces the default minifier used by MinifyHTML.
+	Minifier func([]byte) ([]byte, error)
+	// Add Accept to the Vary header of negotiated responses. Accept-Encoding is added to every response Compression
+	// may compress without it.
+	AutoVary bool
+	// Headers set on every HTML response unless the handler already set them, e.g. Content-Security-Policy or X-Frame-Options.
+	SecurityHeaders map[string]string
+	// Generate a random nonce per request for templates to use as {{ cspNonce }} in <script nonce="...">, and add it
+	// to the script-src directive of the Content-Security-Policy header of HTML responses.
+	CSPNonce bool
+	// Recompile templates when a template file changes, in any environment. Always enabled in macaron.DEV.
+	// Requests stat every template file for it, at most once a second with the others rendering meanwhile, so
+	// an edit shows up within a second and a large template tree costs a walk per second under load.
+	ReloadOnChange bool
+	// Number of render buffers kept for reuse by the renderer. Default is 64.
+	BufferPoolSize int
+	// OnRender is called after every HTML, JSON and XML render with the template name, or the request path for JSON and XML,
+	// the time from entering the render method to the end of writing the response and the error the render or writing the response failed with.
+	OnRender func(name string, dur time.Duration, err error)
+	// CaptureFunc is called after every template render written to the response with the template name and a copy of
+	// the bytes sent, before compression, e.g. for golden files. HTMLStream renders that flushed and ETag matches
+	// answered with an empty 304 are not captured.
+	CaptureFunc func(name string, out []byte)
+	// RenderTimeout fails template renders that take longer with a 503, rendered with ErrorTemplates[503] when there
+	// is one. A render that timed out still runs to its end in the background, holding its goroutine and buffer.
+	// HTMLStream isn't timed. Default is 0 which waits for every render.
+	RenderTimeout time.Duration
+	// Count renders by content type and status and keep a histogram of their durations, see Stats. Templates.Stats of a
+	// Precompile reads them outside of requests, e.g. to register them with a metrics registry at startup.
+	EnableMetrics bool
+	// Logger receives one line per HTML render with the set, template name and duration. Default is nil which logs nothing.
+	Logger *log.Logger
+	// Recover panics while a response body is written, File included, e.g. of a wrapping ResponseWriter or of a
+	// streamed MarshalJSON. They are logged with their stack to Logger and answered with a 500 unless the status was
+	// sent. Template funcs that panic fail their render without it.
+	RecoverPanics bool
 }
 
+// Renderer compiles the templates once and returns the middleware, it panics
+// when the templates can't be compiled. The panic value is an error wrapping
+// the compile error, so errors.As finds e.g. the parse error with its file
+// and line. Use New to handle the error instead.
 func Renderer(options ...Options) macaron.Handler {
-	opt := prepareOptions(options)
+	var opt Options
+	if len(options) > 0 {
+		opt = options[0]
+	}
+
+	h, err := New(opt)
+	if err != nil {
+		panic(fmt.Errorf("renders: compiling templates: %w", err))
+	}
+	return h
+}
+
+// MustRenderer is an alias of Renderer, kept for the naming symmetry with New
+func MustRenderer(options ...Options) macaron.Handler {
+	return Renderer(options...)
+}
+
+// New compiles the templates once and returns the middleware, or the error
+// that prevented the templates from compiling
+func New(options Options) (macaron.Handler, error) {
+	t, err := Precompile(options)
+	if err != nil {
+		return nil, err
+	}
+	return RendererFromTemplates(t, options), nil
+}
+
+// RendererFromTemplates returns the middleware rendering the templates of t
+// without parsing them again. opt sets everything else, its options that
+// describe the templates, like Directory or Funcs, only apply to sets added
+// with SetTemplatePath. CaseInsensitiveNames and TextMode are those of t.
+func RendererFromTemplates(t *Templates, opt Options) macaron.Handler {
+	// names are registered and escaped the way t was compiled, TextMode also
+	// decides the default HTMLContentType
+	opt.CaseInsensitiveNames = t.opt.CaseInsensitiveNames
+	opt.TextMode = t.opt.TextMode
+	opt = prepareOptions([]Options{opt})
 	cs := prepareCharset(opt.Charset)
-	bufpool = bpool.NewBufferPool(64)
+	pool := bpool.NewBufferPool(opt.BufferPoolSize)
+
+	var m *metrics
+	if opt.EnableMetrics {
+		m = t.metrics
+	}
+
+	sets := newTemplateSets()
+	t.register(sets)
+
 	return func(res http.ResponseWriter, req *http.Request, c *macaron.Context) {
-		if macaron.Env == macaron.DEV {
-			// recompile for easy development
-			compile(opt)
+		if t.reload {
+			// recompile for easy development, but only when a template file changed
+			t.refresh()
 		}
+
 		r := &renderer{
 			ResponseWriter:  res,
 			req:             req,
-			t:               templates,
+			sets:            sets,
+			bufpool:         pool,
 			opt:             opt,
 			compiledCharset: cs,
+			metrics:         m,
 		}
 		c.Render = r // questionable assignment
 		c.MapTo(r, (*macaron.Render)(nil))
+		c.MapTo(r, (*Render)(nil))
+		mapMsgPack(c, r)
 	}
 }
 
-func compile(options Options) error {
-	var tmplErr error
-
+func compile(l *loader, options Options) (templateSet, error) {
+	var funcs template.FuncMap
 	if len(options.Funcs) > 0 {
-		templates, tmplErr = LoadWithFuncMap(options)
-		return tmplErr
-	} else {
-		templates, tmplErr = Load(options)
-		return tmplErr
+		funcs = options.Funcs
 	}
-	return nil
+	t, err := l.loadTemplates(funcs)
+	if err != nil {
+		return nil, err
+	}
+
+	set := newTemplateSet(t)
+	for name, ct := range set {
+		ct.meta = l.meta[name]
+	}
+	return set, nil
+}
+
+// RenderToString loads the templates described by opt and renders the
+// template name with data like HTMLString would, without any HTTP request.
+// It is meant for tests and tools, every call loads all templates again.
+func RenderToString(opt Options, name string, data interface{}, htmlOpt ...macaron.HTMLOptions) (string, error) {
+	opt = prepareOptions([]Options{opt})
+	t, err := compile(newLoader(opt), opt)
+	if err != nil {
+		return "", err
+	}
+
+	sets := newTemplateSets()
+	sets.set(defaultTplSetName, t)
+	r := &renderer{
+		sets:            sets,
+		bufpool:         bpool.NewBufferPool(1),
+		opt:             opt,
+		compiledCharset: prepareCharset(opt.Charset),
+	}
+	return r.HTMLString(name, data, htmlOpt...)
+}
+
+// unescapedSet reports whether the template set is listed in UnescapedSets
+func (opt Options) unescapedSet(setName string) bool {
+	return containsString(opt.UnescapedSets, setName)
 }
 
+// noCharset as Options.Charset leaves the charset parameter out
+const noCharset = "-"
+
 func prepareCharset(charset string) string {
+	if charset == noCharset {
+		return ""
+	}
 	if len(charset) != 0 {
 		return "; charset=" + charset
 	}
@@ -111,216 +379,1399 @@ func prepareOptions(options []Options) Options {
 		opt.Directory = "templates"
 	}
 	if len(opt.Extensions) == 0 {
-		opt.Extensions = []string{".html"}
+		opt.Extensions = append([]string(nil), DefaultExtensions...)
 	}
 	if len(opt.HTMLContentType) == 0 {
 		opt.HTMLContentType = ContentHTML
+		if opt.TextMode {
+			opt.HTMLContentType = ContentPlain
+		}
+	}
+	if len(opt.IndentString) == 0 {
+		opt.IndentString = "  "
+	}
+	if opt.BufferPoolSize <= 0 {
+		opt.BufferPoolSize = 64
+	}
+	if len(opt.LeftDelim) == 0 {
+		opt.LeftDelim = defaultLeftDelim
+	}
+	if len(opt.RightDelim) == 0 {
+		opt.RightDelim = defaultRightDelim
 	}
 
 	return opt
 }
 
+// Render is what the middleware injects besides macaron.Render: every
+// method of the renderer, so handlers can take a renders.Render. MsgPack is
+// left out since it only exists with the msgpack build tag, see MsgPackRender.
+type Render interface {
+	macaron.Render
+
+	StatusCode() int
+	Size() int
+	Clone(opt Options) Render
+	Stats() Stats
+
+	JSONP(status int, callback string, v interface{})
+	JSONBytes(v interface{}) ([]byte, error)
+	XMLString(v interface{}) (string, error)
+	XMLBytes(v interface{}) ([]byte, error)
+	YAML(status int, v interface{})
+	TOML(status int, v interface{})
+	CSV(status int, records [][]string)
+	CSVWithName(status int, filename string, records [][]string)
+	PDF(status int, v []byte)
+	PDFWithName(status int, filename string, v []byte)
+	File(status int, path string)
+	DataWithType(status int, contentType string, v []byte)
+	PlainString(status int, s string)
+	PlainTextf(status int, format string, args ...interface{})
+	Render(status int, contentType string, v interface{})
+	Negotiate(status int, v interface{}, htmlName string, data interface{})
+	Stream(status int, ch <-chan interface{})
+
+	HTMLModified(status int, name string, modTime time.Time, binding interface{}, htmlOpt ...macaron.HTMLOptions)
+	HTMLCharset(status int, charset, name string, binding interface{}, htmlOpt ...macaron.HTMLOptions)
+	HTMLWithFuncs(status int, name string, data interface{}, funcs template.FuncMap, htmlOpt ...macaron.HTMLOptions)
+	HTMLStream(status int, name string, data interface{}, htmlOpt ...macaron.HTMLOptions)
+	HTMLFragments(status int, names []string, data interface{})
+	HTMLTable(status int, v interface{})
+	HTMLResult(name string, data interface{}, htmlOpt ...macaron.HTMLOptions) ([]byte, int, error)
+	RenderTo(w io.Writer, name string, data interface{}, htmlOpt ...macaron.HTMLOptions) error
+	RenderTemplate(status int, t *template.Template, name string, data interface{})
+	AddFunc(name string, fn interface{})
+
+	StatusWithText(status int, text string)
+	Redirect(location string, status ...int)
+
+	ReloadSet(setName string) error
+	Template(name string) *template.Template
+	TemplateNames() []string
+	TemplateSetNames(setName string) []string
+}
+
+var _ Render = (*renderer)(nil)
+
 type renderer struct {
 	http.ResponseWriter
-	req             *http.Request
-	t               map[string]*template.Template
+	req *http.Request
+	// the default set is looked up on every render, so a set added or
+	// reloaded by any goroutine is used right away
+	sets *templateSets
+	// Provides a temporary buffer to execute templates into and catch errors.
+	bufpool         *bpool.BufferPool
 	opt             Options
 	compiledCharset string
-
-	startTime time.Time
+	// funcs added for this request only, see AddFunc. lock guards them, so
+	// one request may render from several goroutines.
+	lock  sync.Mutex
+	funcs template.FuncMap
+	// locale of the request, see LocalizeTemplates and Translator
+	localeOnce     sync.Once
+	reqLocale      string
+	translatorOnce sync.Once
+	// set while an error template renders
+	inErrorTemplate bool
+	// values of Options.DataFunc for this request, set by the first render
+	globalOnce sync.Once
+	global     map[string]interface{}
+	// CSP nonce of the request, see CSPNonce
+	nonceOnce  sync.Once
+	nonce      string
+	nonceErr   error
+	nonceBound sync.Once
+	// what was written to the response, shared with clones, see written
+	respOnce sync.Once
+	resp     *responseState
+	// shared by the renderers of all requests, nil unless EnableMetrics is set
+	metrics *metrics
 }
 
 func (r *renderer) SetResponseWriter(rw http.ResponseWriter) {
 	r.ResponseWriter = rw
 }
 
+// responseState is what the renderers of a response wrote to it
+type responseState struct {
+	status int
+	size   int
+}
+
+// written returns the state of the response, created on first use
+func (r *renderer) written() *responseState {
+	r.respOnce.Do(func() {
+		if r.resp == nil {
+			r.resp = &responseState{}
+		}
+	})
+	return r.resp
+}
+
+// WriteHeader writes the status unless one was already written, a second
+// status is dropped with a warning instead of the one net/http would log
+func (r *renderer) WriteHeader(status int) {
+	if r.headerWritten() {
+		if r.opt.Logger != nil {
+			r.opt.Logger.Printf("renders: status %d ignored, the status was already written", status)
+		}
+		return
+	}
+	r.setDefaultHeaders()
+	r.written().status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the 200 status first unless a status was written. One written
+// past the renderer isn't recorded, StatusCode asks the writer for it.
+func (r *renderer) Write(b []byte) (int, error) {
+	if !r.headerWritten() {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.written().size += n
+	return n, err
+}
+
+// headerWritten reports whether the status went out, through this renderer
+// or, for writers that tell like macaron's, through any other
+func (r *renderer) headerWritten() bool {
+	if w, ok := r.ResponseWriter.(interface{ Written() bool }); ok && w.Written() {
+		return true
+	}
+	return r.written().status != 0
+}
+
+// StatusCode returns the status written to the response, 0 while none was.
+// It is not named Status, which writes the status for macaron.Render.
+func (r *renderer) StatusCode() int {
+	if status := r.written().status; status != 0 {
+		return status
+	}
+	if w, ok := r.ResponseWriter.(interface{ Status() int }); ok {
+		return w.Status()
+	}
+	return 0
+}
+
+// Size returns the number of body bytes written to the response by the
+// renderer, after compression
+func (r *renderer) Size() int {
+	return r.written().size
+}
+
+// Clone returns a renderer for the same response that shares the compiled
+// templates, buffer pool and metrics but renders with opt. Options that only
+// matter for loading templates, like Directory, Funcs or the delimiters, have
+// no effect since nothing is recompiled. CaseInsensitiveNames and TextMode
+// are those of r.
+func (r *renderer) Clone(opt Options) Render {
+	// names stay registered and escaped the way the templates were compiled,
+	// TextMode also decides the default HTMLContentType
+	opt.CaseInsensitiveNames = r.opt.CaseInsensitiveNames
+	opt.TextMode = r.opt.TextMode
+	opt = prepareOptions([]Options{opt})
+	c := &renderer{
+		ResponseWriter:  r.ResponseWriter,
+		req:             r.req,
+		sets:            r.sets,
+		bufpool:         r.bufpool,
+		opt:             opt,
+		compiledCharset: prepareCharset(opt.Charset),
+		metrics:         r.metrics,
+		resp:            r.written(),
+	}
+	// funcs are never modified in place, so both can share them
+	c.funcs = r.requestFuncs()
+	return c
+}
+
 func (r *renderer) JSON(status int, v interface{}) {
-	var result []byte
 	var err error
-	if r.opt.IndentJSON {
-		result, err = json.MarshalIndent(v, "", "  ")
-	} else {
-		result, err = json.Marshal(v)
+	defer r.timeRender(ContentJSON, status, r.routeName(), time.Now(), &err)
+
+	if r.opt.StreamJSON {
+		err = r.streamJSON(status, v)
+		return
 	}
-	if err != nil {
-		http.Error(r, err.Error(), 500)
+
+	var result []byte
+	if result, err = r.marshalJSON(v); err != nil {
+		r.httpError(http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	// json rendered fine, write out the result
+	_, err = r.writeBody(status, ContentJSON+r.compiledCharset, r.opt.PrefixJSON, result)
+}
+
+// marshalJSON marshals v, indented when IndentJSON is set
+func (r *renderer) marshalJSON(v interface{}) ([]byte, error) {
+	if r.opt.UnescapeHTMLJSON {
+		var buf bytes.Buffer
+		enc := r.jsonEncoder(&buf)
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+		// unlike Marshal, Encode ends the value with a newline
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+	}
+	if r.opt.IndentJSON {
+		return json.MarshalIndent(v, r.opt.IndentPrefix, r.opt.IndentString)
+	}
+	return json.Marshal(v)
+}
+
+// streamJSON encodes v with an encoder writing into the response. The status
+// is sent before encoding starts, so an encoding error can no longer be
+// turned into a 500, and no Content-Length is set. net/http may still add one
+// for a small body it buffered whole. The encoder still marshals v into its
+// own buffer before the first write.
+func (r *renderer) streamJSON(status int, v interface{}) (err error) {
+	if r.opt.RecoverPanics {
+		defer r.recoverPanic(ContentJSON, &err)
+	}
 	r.Header().Set(ContentType, ContentJSON+r.compiledCharset)
 	r.WriteHeader(status)
-	if len(r.opt.PrefixJSON) > 0 {
-		r.Write(r.opt.PrefixJSON)
+	if err := writeAll(r, [][]byte{r.byteOrderMark(ContentJSON), r.opt.PrefixJSON}); err != nil {
+		return err
 	}
-	r.Write(result)
+
+	if err := r.jsonEncoder(r).Encode(v); err != nil {
+		return err
+	}
+	r.setTrailers()
+	return nil
 }
 
-func (r *renderer) JSONString(v interface{}) (string, error) {
-	var result []byte
-	var err error
+// setTrailers sets the Options.TrailerFunc values as trailers of a streamed
+// response. The body is flushed first, which makes net/http send it chunked
+// as trailers need. They carry http.TrailerPrefix, so they don't have to be
+// declared in a Trailer header before TrailerFunc could name them. HTTP/1.0
+// has no trailers.
+func (r *renderer) setTrailers() {
+	if r.opt.TrailerFunc == nil || r.req == nil || !r.req.ProtoAtLeast(1, 1) {
+		return
+	}
+	r.flushFunc()()
+	for k, v := range r.opt.TrailerFunc() {
+		r.Header().Set(http.TrailerPrefix+k, v)
+	}
+}
+
+// jsonEncoder returns an encoder writing to w with the JSON options applied
+func (r *renderer) jsonEncoder(w io.Writer) *json.Encoder {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(!r.opt.UnescapeHTMLJSON)
 	if r.opt.IndentJSON {
-		result, err = json.MarshalIndent(v, "", "  ")
-	} else {
-		result, err = json.Marshal(v)
+		enc.SetIndent(r.opt.IndentPrefix, r.opt.IndentString)
+	}
+	return enc
+}
+
+// JSONP writes v as JSON wrapped in a call to the given callback
+func (r *renderer) JSONP(status int, callback string, v interface{}) {
+	if !reJSONPCallback.MatchString(callback) {
+		r.httpError(http.StatusInternalServerError, fmt.Sprintf("render: invalid JSONP callback %q", callback))
+		return
 	}
+
+	result, err := r.marshalJSON(v)
 	if err != nil {
-		return "", err
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// json rendered fine, write out the result wrapped in the callback
+	result = append(append([]byte(callback+"("), result...), ");"...)
+	r.writeBody(status, ContentJSONP+r.compiledCharset, result)
+}
+
+// JSONString returns what JSON writes for v, PrefixJSON included like
+// XMLString includes PrefixXML
+func (r *renderer) JSONString(v interface{}) (string, error) {
+	result, err := r.JSONBytes(v)
+	return string(result), err
+}
+
+// JSONBytes returns what JSON writes for v, PrefixJSON included
+func (r *renderer) JSONBytes(v interface{}) ([]byte, error) {
+	result, err := r.marshalJSON(v)
+	if err != nil {
+		return nil, err
 	}
-	return string(result), nil
+	return append(append([]byte(nil), r.opt.PrefixJSON...), result...), nil
 }
 
 func (r *renderer) HTML(status int, name string, binding interface{}, htmlOpt ...macaron.HTMLOptions) {
-	log.Println("HTML: name: " + name)
-	t := r.t[name]
-	buf, err := r.execute(t, name, binding)
-	//fmt.Println(buf.String())
+	r.renderHTML(status, defaultTplSetName, name, "", binding, nil, htmlOpt...)
+}
+
+// HTMLModified renders the named template like HTML with a Last-Modified
+// header of modTime. A 200 for a request whose If-Modified-Since isn't older
+// than modTime is answered with an empty 304 without rendering.
+func (r *renderer) HTMLModified(status int, name string, modTime time.Time, binding interface{}, htmlOpt ...macaron.HTMLOptions) {
+	if !modTime.IsZero() {
+		r.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		if status == http.StatusOK && r.notModifiedSince(modTime) {
+			r.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	r.renderHTML(status, defaultTplSetName, name, "", binding, nil, htmlOpt...)
+}
+
+// notModifiedSince reports whether the request's If-Modified-Since covers
+// modTime. It is ignored with an If-None-Match, which takes precedence.
+func (r *renderer) notModifiedSince(modTime time.Time) bool {
+	if r.req == nil || (r.req.Method != http.MethodGet && r.req.Method != http.MethodHead) {
+		return false
+	}
+	if len(r.req.Header.Get("If-None-Match")) > 0 {
+		return false
+	}
+	since, err := http.ParseTime(r.req.Header.Get("If-Modified-Since"))
 	if err != nil {
-		http.Error(r, err.Error(), http.StatusInternalServerError)
-		return
+		return false
 	}
+	// the header has a resolution of seconds
+	return !modTime.Truncate(time.Second).After(since)
+}
 
-	// template rendered fine, write out the result
-	r.Header().Set(ContentType, r.opt.HTMLContentType+r.compiledCharset)
-	r.WriteHeader(status)
-	io.Copy(r, buf)
-	bufpool.Put(buf)
+// HTMLCharset renders the named template like HTML, but announces the given
+// charset in the Content-Type instead of Options.Charset
+func (r *renderer) HTMLCharset(status int, charset, name string, binding interface{}, htmlOpt ...macaron.HTMLOptions) {
+	r.renderHTML(status, defaultTplSetName, name, charset, binding, nil, htmlOpt...)
+}
+
+// htmlContentType returns the Content-Type of HTML responses, charset
+// overrides Options.Charset when it is not empty
+func (r *renderer) htmlContentType(charset string) string {
+	return r.withCharset(r.opt.HTMLContentType, charset)
+}
+
+// templateContentType returns the Content-Type of a render of tplName, the
+// one Options.ExtensionContentType maps the extension of its file to or the
+// HTML one
+func (r *renderer) templateContentType(setName, tplName, charset string) string {
+	if len(r.opt.ExtensionContentType) > 0 {
+		name := tplName
+		if ct := r.findTemplate(setName, tplName); ct != nil {
+			name = ct.master.Name()
+		}
+		if contentType, ok := r.opt.ExtensionContentType[path.Ext(name)]; ok {
+			return r.withCharset(contentType, charset)
+		}
+	}
+	return r.htmlContentType(charset)
+}
+
+// withCharset appends the charset parameter to contentType, charset
+// overrides Options.Charset when it is not empty
+func (r *renderer) withCharset(contentType, charset string) string {
+	if len(charset) == 0 {
+		return contentType + r.compiledCharset
+	}
+	return contentType + prepareCharset(charset)
 }
 
 func (r *renderer) XML(status int, v interface{}) {
-	var result []byte
 	var err error
+	defer r.timeRender(ContentXML, status, r.routeName(), time.Now(), &err)
+
+	var result []byte
+	if result, err = r.marshalXML(v); err != nil {
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// XML rendered fine, write out the result
+	_, err = r.writeBody(status, ContentXML+r.compiledCharset, r.xmlHeader(), r.opt.PrefixXML, result)
+}
+
+// xmlHeader returns the XML declaration XMLHeader asks for, nil without
+func (r *renderer) xmlHeader() []byte {
+	if !r.opt.XMLHeader {
+		return nil
+	}
+	switch r.opt.Charset {
+	case noCharset:
+		return []byte(`<?xml version="1.0"?>` + "\n")
+	case "":
+		return []byte(`<?xml version="1.0" encoding="` + defaultCharset + `"?>` + "\n")
+	}
+	return []byte(`<?xml version="1.0" encoding="` + r.opt.Charset + `"?>` + "\n")
+}
+
+// marshalXML marshals v, indented when IndentXML is set
+func (r *renderer) marshalXML(v interface{}) ([]byte, error) {
 	if r.opt.IndentXML {
-		result, err = xml.MarshalIndent(v, "", "  ")
-	} else {
-		result, err = xml.Marshal(v)
+		return xml.MarshalIndent(v, r.opt.IndentPrefix, r.opt.IndentString)
+	}
+	return xml.Marshal(v)
+}
+
+// XMLString returns what XML writes for v, XMLHeader and PrefixXML included
+func (r *renderer) XMLString(v interface{}) (string, error) {
+	result, err := r.XMLBytes(v)
+	return string(result), err
+}
+
+// XMLBytes returns what XML writes for v, XMLHeader and PrefixXML included
+func (r *renderer) XMLBytes(v interface{}) ([]byte, error) {
+	result, err := r.marshalXML(v)
+	if err != nil {
+		return nil, err
 	}
+	return append(append(r.xmlHeader(), r.opt.PrefixXML...), result...), nil
+}
+
+func (r *renderer) YAML(status int, v interface{}) {
+	result, err := yaml.Marshal(v)
 	if err != nil {
-		http.Error(r, err.Error(), 500)
+		r.httpError(http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// XML rendered fine, write out the result
-	r.Header().Set(ContentType, ContentXML+r.compiledCharset)
+	// YAML rendered fine, write out the result
+	r.writeBody(status, ContentYAML+r.compiledCharset, r.opt.PrefixYAML, result)
+}
+
+// writeBody sets the Content-Type and Content-Length of an already rendered
+// body, then writes the status and the body parts in order. When compression
+// is enabled and the client accepts gzip the body is compressed instead and
+// sent without a Content-Length. With ETags enabled a 200 response to a GET
+// or HEAD request whose ETag matches its If-None-Match becomes an empty 304.
+// HEAD gets the headers a GET would, the body is left out.
+// sent is false when the body was left out for a 304, the returned error
+// tells that the body could not be written completely.
+func (r *renderer) writeBody(status int, contentType string, body ...[]byte) (sent bool, err error) {
+	if r.opt.RecoverPanics {
+		defer r.recoverPanic(contentType, &err)
+	}
+	if bom := r.byteOrderMark(contentType); bom != nil {
+		body = append([][]byte{bom}, body...)
+	}
+
+	size := 0
+	for _, b := range body {
+		size += len(b)
+	}
+
+	compressible := r.compressible(status, size)
+	gzipped := compressible && acceptsGzip(r.req)
+	if compressible {
+		// compressed or not, the body depends on Accept-Encoding, caches must
+		// know, a 304 included
+		r.addVary("Accept-Encoding")
+	}
+
+	if r.opt.ETag && status == http.StatusOK {
+		h := sha1.New()
+		for _, b := range body {
+			h.Write(b)
+		}
+		// a strong validator differs per content coding, decided for HEAD
+		// like for GET so the validator of one matches the other
+		etag := `"` + hex.EncodeToString(h.Sum(nil))
+		if gzipped {
+			etag += "-gzip"
+		}
+		etag += `"`
+		r.Header().Set("ETag", etag)
+		// like If-Modified-Since, other methods render as if it was missing
+		if r.req != nil && (r.req.Method == http.MethodGet || r.req.Method == http.MethodHead) &&
+			etagMatches(r.req.Header.Get("If-None-Match"), etag) {
+			r.WriteHeader(http.StatusNotModified)
+			return false, nil
+		}
+	}
+
+	r.Header().Set(ContentType, contentType)
+	// HEAD gets the headers of the GET, without the body
+	head := r.req != nil && r.req.Method == http.MethodHead
+	if gzipped {
+		r.Header().Del(ContentLength)
+		r.Header().Set(ContentEncoding, "gzip")
+		r.WriteHeader(status)
+		if head {
+			return true, nil
+		}
+
+		gz := gzip.NewWriter(r)
+		if err := writeAll(gz, body); err != nil {
+			return true, err
+		}
+		return true, gz.Close()
+	}
+
+	r.Header().Set(ContentLength, strconv.Itoa(size))
 	r.WriteHeader(status)
-	if len(r.opt.PrefixXML) > 0 {
-		r.Write(r.opt.PrefixXML)
+	if head {
+		return true, nil
 	}
-	r.Write(result)
+	return true, writeAll(r, body)
+}
+
+// recoverPanic is deferred by the body writing code with RecoverPanics. A
+// panic, e.g. of the ResponseWriter or a marshaler, is logged with its stack
+// and becomes the error of the write, answered with a 500 unless the status
+// is already out. what names the body for the log line.
+func (r *renderer) recoverPanic(what string, err *error) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	e := fmt.Errorf("render: panic writing %s: %v", what, p)
+	if err != nil {
+		*err = e
+	}
+	if r.opt.Logger != nil {
+		r.opt.Logger.Printf("renders: %v\n%s", e, debug.Stack())
+	}
+	if r.headerWritten() {
+		return
+	}
+	// the writer may panic again, it must not get past us this time
+	defer func() { recover() }()
+	r.Header().Del(ContentLength)
+	r.Header().Del(ContentEncoding)
+	http.Error(r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// writeAll writes the body parts to w in order, stopping at the first failed
+// or short write
+func writeAll(w io.Writer, body [][]byte) error {
+	for _, b := range body {
+		n, err := w.Write(b)
+		if err != nil {
+			return fmt.Errorf("render: writing response: %w", err)
+		}
+		if n < len(b) {
+			return fmt.Errorf("render: writing response: %w", io.ErrShortWrite)
+		}
+	}
+	return nil
+}
+
+// compressible reports whether a body of size bytes sent with status may be
+// gzipped: never when empty or for statuses without a body. HEAD is decided
+// like GET, so both get the same headers.
+func (r *renderer) compressible(status, size int) bool {
+	if !r.opt.Compression || size == 0 || size < r.opt.CompressionMinLength {
+		return false
+	}
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// vary adds name to the Vary header with AutoVary, see addVary
+func (r *renderer) vary(name string) {
+	if !r.opt.AutoVary {
+		return
+	}
+	r.addVary(name)
+}
+
+// addVary adds name to the Vary header, keeping the names already listed
+// and listing each one once
+func (r *renderer) addVary(name string) {
+	var names []string
+	for _, v := range r.Header().Values("Vary") {
+		for _, n := range strings.Split(v, ",") {
+			if n = strings.TrimSpace(n); len(n) == 0 {
+				continue
+			}
+			if n == "*" || strings.EqualFold(n, name) {
+				return
+			}
+			names = append(names, n)
+		}
+	}
+	r.Header().Set("Vary", strings.Join(append(names, name), ", "))
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip
+func acceptsGzip(req *http.Request) bool {
+	if req == nil {
+		return false
+	}
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		name := strings.TrimSpace(parts[0])
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		// gzip;q=0 explicitly refuses gzip
+		if len(parts) > 1 {
+			q := strings.TrimSpace(parts[1])
+			if v, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (r *renderer) TOML(status int, v interface{}) {
+	var result bytes.Buffer
+	enc := toml.NewEncoder(&result)
+	if !r.opt.IndentTOML {
+		enc.Indent = ""
+	}
+	if err := enc.Encode(v); err != nil {
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// TOML rendered fine, write out the result
+	r.writeBody(status, ContentTOML+r.compiledCharset, result.Bytes())
+}
+
+func (r *renderer) CSV(status int, records [][]string) {
+	r.CSVWithName(status, "", records)
+}
+
+// CSVWithName renders records as CSV like CSV and, when filename is not
+// empty, asks the client to download it as an attachment under that name
+func (r *renderer) CSVWithName(status int, filename string, records [][]string) {
+	var result bytes.Buffer
+	w := csv.NewWriter(&result)
+	w.WriteAll(records) // calls Flush
+	if err := w.Error(); err != nil {
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// CSV rendered fine, write out the result
+	if len(filename) > 0 {
+		r.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	r.writeBody(status, ContentCSV+r.compiledCharset, result.Bytes())
+}
+
+// PDF writes the bytes of a PDF document for the browser to show inline
+func (r *renderer) PDF(status int, v []byte) {
+	r.Header().Set("Content-Disposition", "inline")
+	r.writeBody(status, ContentPDF, v)
+}
+
+// PDFWithName writes a PDF document like PDF, but asks the client to
+// download it as an attachment under filename
+func (r *renderer) PDFWithName(status int, filename string, v []byte) {
+	r.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	r.writeBody(status, ContentPDF, v)
 }
 
 func (r *renderer) data(status int, contentType string, v []byte) {
-	if r.Header().Get(ContentType) == "" {
-		r.Header().Set(ContentType, contentType)
+	// a Content-Type the handler set wins
+	if ct := r.Header().Get(ContentType); len(ct) > 0 {
+		contentType = ct
 	}
-	r.WriteHeader(status)
-	r.Write(v)
+	r.writeBody(status, contentType, v)
 }
 
 func (r *renderer) RawData(status int, v []byte) {
 	r.data(status, ContentBinary, v)
 }
 
+// File streams the file at path with the given status. The content type is
+// taken from the extension or sniffed from the start of the file. A missing
+// file is answered with 404 and any other error opening it with 500.
+func (r *renderer) File(status int, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			r.httpError(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+			return
+		}
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if fi.IsDir() {
+		r.httpError(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if len(contentType) == 0 {
+		var head [512]byte
+		n, err := io.ReadFull(f, head[:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			r.httpError(http.StatusInternalServerError, err.Error())
+			return
+		}
+		contentType = http.DetectContentType(head[:n])
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			r.httpError(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if r.opt.RecoverPanics {
+		defer r.recoverPanic(path, nil)
+	}
+	r.Header().Set(ContentType, contentType)
+	r.Header().Set(ContentLength, strconv.FormatInt(fi.Size(), 10))
+	r.WriteHeader(status)
+	io.Copy(r, f)
+}
+
 func (r *renderer) PlainText(status int, v []byte) {
 	r.data(status, ContentPlain, v)
 }
 
-func (r *renderer) execute(t *template.Template, name string, data interface{}) (*bytes.Buffer, error) {
-	buf := bufpool.Get()
-	return buf, t.ExecuteTemplate(buf, name, data)
+// DataWithType writes v with exactly the given Content-Type, replacing one
+// set before. Textual types without a charset parameter get the configured
+// charset appended.
+func (r *renderer) DataWithType(status int, contentType string, v []byte) {
+	if isTextual(contentType) && !strings.Contains(contentType, "charset=") {
+		contentType += r.compiledCharset
+	}
+	r.writeBody(status, contentType, v)
+}
+
+// utf8BOM is the UTF-8 encoded byte order mark
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// byteOrderMark returns the BOM written before a body of contentType, nil
+// unless UTF8BOM is set and the body is UTF-8 JSON, XML, plain text or HTML
+func (r *renderer) byteOrderMark(contentType string) []byte {
+	if !r.opt.UTF8BOM {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+		return nil
+	}
+	switch {
+	case mediaType == ContentJSON, strings.HasSuffix(mediaType, "+json"),
+		mediaType == ContentXML, mediaType == "application/xml", strings.HasSuffix(mediaType, "+xml"),
+		mediaType == ContentPlain, mediaType == ContentHTML:
+		return utf8BOM
+	}
+	return nil
+}
+
+// isTextual reports whether a media type carries text that a charset applies to
+func isTextual(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+xml"),
+		strings.HasSuffix(mediaType, "+json"),
+		mediaType == ContentJSON,
+		mediaType == ContentJSONP,
+		mediaType == "application/xml":
+		return true
+	}
+	return false
+}
+
+// PlainString writes s as text/plain
+func (r *renderer) PlainString(status int, s string) {
+	r.data(status, ContentPlain, []byte(s))
+}
+
+// PlainTextf formats according to format and writes the result as text/plain
+func (r *renderer) PlainTextf(status int, format string, args ...interface{}) {
+	r.data(status, ContentPlain, []byte(fmt.Sprintf(format, args...)))
+}
+
+// execute renders the named template into a pooled buffer. On success the
+// caller owns the buffer and puts it back, on error it is already back.
+func (r *renderer) execute(t engineTemplate, name string, data interface{}) (*bytes.Buffer, error) {
+	buf := r.bufpool.Get()
+	if err := t.ExecuteTemplate(buf, name, data); err != nil {
+		r.bufpool.Put(buf)
+		return nil, err
+	}
+	return buf, nil
 }
 
-func (r *renderer) addYield(t *template.Template, tplName string, data interface{}) {
-	funcs := template.FuncMap{
+// yieldFuncs returns the funcs of a layout, yield renders the remaining
+// layouts around the template name, current always reports name and section
+// renders a region defined by one of the templates inside the layout
+func (r *renderer) yieldFuncs(setName string, layouts []string, name string, data interface{}, funcs template.FuncMap) template.FuncMap {
+	return template.FuncMap{
 		"yield": func() (template.HTML, error) {
-			buf, err := r.execute(t, tplName, data)
+			buf, err := r.renderLayouts(setName, layouts, name, data, funcs)
+			if err != nil {
+				return "", err
+			}
+			defer r.bufpool.Put(buf)
 			// return safe html here since we are rendering our own template
-			return template.HTML(buf.String()), err
-		},
-		"current": func() (string, error) {
-			return tplName, nil
+			return template.HTML(buf.String()), nil
 		},
+		"current": currentFunc(name),
+		"section": r.sectionFunc(setName, append(append([]string(nil), layouts...), name), data, funcs),
 	}
-	t.Funcs(funcs)
 }
 
-func (r *renderer) renderBytes(setName, tplName string, data interface{}, htmlOpt ...macaron.HTMLOptions) (*bytes.Buffer, error) {
-	//t := r.TemplateSet.Get(setName)
-	log.Println(fmt.Sprintf("macaron renderer renderBytes: set name: %s, tplName: %s", setName, tplName))
-	t := r.t[setName]
-	if macaron.Env == macaron.DEV {
-		log.Println("macaron renderer renderBytes")
-		//opt := r.opt
-		//opt.Directory = r.TemplateSet.GetDir(setName)
-		//t = r.TemplateSet.Set(setName, &opt)
+// sectionFunc returns the section func of a layout. It renders the template
+// of that name defined by one of the templates inside the layout, nothing
+// when none defines it and an error when more than one does.
+func (r *renderer) sectionFunc(setName string, inner []string, data interface{}, funcs template.FuncMap) func(string) (template.HTML, error) {
+	return func(section string) (template.HTML, error) {
+		var (
+			owner     engineTemplate
+			ownerName string
+		)
+		for _, name := range inner {
+			t, err := r.lookup(setName, name, funcs)
+			if err != nil {
+				return "", err
+			}
+			if !t.Defines(section) {
+				continue
+			}
+			if owner != nil {
+				return "", fmt.Errorf("render: section %q is defined by both %s and %s", section, ownerName, name)
+			}
+			owner, ownerName = t, name
+		}
+		if owner == nil {
+			return "", nil
+		}
+
+		buf, err := r.execute(owner, section, data)
+		if err != nil {
+			return "", err
+		}
+		defer r.bufpool.Put(buf)
+		return template.HTML(buf.String()), nil
 	}
-	if t == nil {
-		return nil, fmt.Errorf("html/template: template \"%s\" is undefined", tplName)
+}
+
+func currentFunc(name string) func() (string, error) {
+	return func() (string, error) {
+		return name, nil
+	}
+}
+
+func (r *renderer) renderBytes(setName, tplName string, data interface{}, funcs template.FuncMap, htmlOpt ...macaron.HTMLOptions) (*bytes.Buffer, error) {
+	if r.opt.RenderTimeout > 0 {
+		return r.renderBytesTimeout(setName, tplName, data, funcs, htmlOpt...)
+	}
+	buf := r.bufpool.Get()
+	if err := r.renderTo(buf, setName, tplName, data, funcs, nil, htmlOpt...); err != nil {
+		r.bufpool.Put(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// renderBytesTimeout is renderBytes giving up after Options.RenderTimeout.
+// Templates can't be interrupted, so a render that takes too long keeps
+// running in its goroutine until it ends and its buffer is left to the
+// garbage collector, it must not go back to the pool while still written.
+func (r *renderer) renderBytesTimeout(setName, tplName string, data interface{}, funcs template.FuncMap, htmlOpt ...macaron.HTMLOptions) (*bytes.Buffer, error) {
+	// the render may outlive the request handling, so it must not be the
+	// one adding Vary or calling into the request
+	r.bindRequest()
+	buf := r.bufpool.Get()
+	done := make(chan error, 1)
+	go func() {
+		// nothing above this goroutine would recover a panic, e.g. of a
+		// DataValidator, it would end the process
+		defer func() {
+			if p := recover(); p != nil {
+				if r.opt.Logger != nil {
+					r.opt.Logger.Printf("renders: panic rendering %s: %v\n%s", tplName, p, debug.Stack())
+				}
+				done <- fmt.Errorf("render: panic rendering %s: %v", tplName, p)
+			}
+		}()
+		done <- r.renderTo(buf, setName, tplName, data, funcs, nil, htmlOpt...)
+	}()
+
+	timer := time.NewTimer(r.opt.RenderTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			r.bufpool.Put(buf)
+			return nil, err
+		}
+		return buf, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: %s after %s", errRenderTimeout, tplName, r.opt.RenderTimeout)
+	}
+}
+
+// renderErrorStatus is the status of a render that failed with err, 503
+// for a timeout and 500 for anything else
+func renderErrorStatus(err error) int {
+	if errors.Is(err, errRenderTimeout) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// bindRequest resolves what renders take from the request once: the locale,
+// whose Vary header is added with it, T, cspNonce and the DataFunc values
+func (r *renderer) bindRequest() {
+	if r.opt.LocalizeTemplates || r.opt.Translator != nil {
+		r.locale()
 	}
+	r.bindTranslator()
+	r.bindNonce()
+	if r.opt.DataFunc != nil {
+		r.globalData()
+	}
+}
 
+// renderTo renders the template tplName of the set setName with its layouts
+// into w. funcs go to every template of the render, outer only to the
+// outermost one, the first layout when there is one.
+func (r *renderer) renderTo(w io.Writer, setName, tplName string, data interface{}, funcs, outer template.FuncMap, htmlOpt ...macaron.HTMLOptions) error {
+	defer r.logRender(setName, tplName, time.Now())
+	r.bindRequest()
+	data = r.templateData(data)
 	opt := r.prepareHTMLOptions(htmlOpt)
+	if meta := r.templateMeta(setName, tplName); meta != nil {
+		data = withMeta(data, meta)
+		// a layout of the call wins over the front matter, which wins over Options.Layout
+		if layout := frontMatterLayout(meta); len(layout) > 0 && (len(htmlOpt) == 0 || len(htmlOpt[0].Layout) == 0) {
+			opt.Layout = layout
+		}
+	}
+
+	if err := r.validateData(tplName, data); err != nil {
+		return err
+	}
+
+	name, extra := tplName, mergeFuncs(funcs, outer)
+	if layouts := splitLayouts(opt.Layout); len(layouts) > 0 {
+		name, extra = layouts[0], mergeFuncs(funcs, r.yieldFuncs(setName, layouts[1:], tplName, data, funcs), outer)
+	}
+	t, err := r.lookup(setName, name, extra)
+	if err != nil {
+		return err
+	}
+	return t.ExecuteTemplate(w, t.Name(), data)
+}
 
-	if len(opt.Layout) > 0 {
-		r.addYield(t, tplName, data)
-		tplName = opt.Layout
+// renderLayouts renders the first of layouts, whose yield renders the next
+// one and so on until the innermost yield renders the template name
+func (r *renderer) renderLayouts(setName string, layouts []string, name string, data interface{}, funcs template.FuncMap) (*bytes.Buffer, error) {
+	if len(layouts) == 0 {
+		t, err := r.lookup(setName, name, mergeFuncs(funcs, template.FuncMap{"current": currentFunc(name)}))
+		if err != nil {
+			return nil, err
+		}
+		return r.execute(t, t.Name(), data)
 	}
 
-	out, err := r.execute(t, tplName, data)
+	t, err := r.lookup(setName, layouts[0], mergeFuncs(funcs, r.yieldFuncs(setName, layouts[1:], name, data, funcs)))
 	if err != nil {
 		return nil, err
 	}
+	return r.execute(t, t.Name(), data)
+}
+
+// mergeFuncs returns the funcs of all maps, later ones win, nil when there
+// are none
+func mergeFuncs(maps ...template.FuncMap) template.FuncMap {
+	var merged template.FuncMap
+	for _, m := range maps {
+		for k, f := range m {
+			if merged == nil {
+				merged = make(template.FuncMap)
+			}
+			merged[k] = f
+		}
+	}
+	return merged
+}
+
+// splitLayouts splits a layout chain like "base.html,section.html" into its
+// layouts, outermost first
+func splitLayouts(layout string) []string {
+	var layouts []string
+	for _, l := range strings.Split(layout, ",") {
+		if l = strings.TrimSpace(l); len(l) > 0 {
+			layouts = append(layouts, l)
+		}
+	}
+	return layouts
+}
+
+// logRender writes a single line about a finished render to the configured
+// logger, it does nothing when no logger is set
+func (r *renderer) logRender(setName, tplName string, start time.Time) {
+	if r.opt.Logger == nil {
+		return
+	}
+	r.opt.Logger.Printf("renders: set=%q template=%q duration=%s", setName, tplName, time.Since(start))
+}
+
+// timeRender reports a finished render to Options.OnRender and the metrics,
+// start is when the render method was entered and err points at the error
+// it ended with
+func (r *renderer) timeRender(contentType string, status int, name string, start time.Time, err *error) {
+	if r.opt.OnRender == nil && r.metrics == nil {
+		return
+	}
+	dur := time.Since(start)
+	r.observe(contentType, status, dur, *err)
+	if r.opt.OnRender != nil {
+		r.opt.OnRender(name, dur, *err)
+	}
+}
+
+// routeName names a render without a template after the request path
+func (r *renderer) routeName() string {
+	if r.req == nil {
+		return ""
+	}
+	return r.req.URL.Path
+}
+
+// renderHTML renders tplName from the set setName and writes it out, nothing
+// is written once the request was cancelled. Executing a template can't be
+// interrupted, so a cancellation while it runs is only noticed afterwards.
+func (r *renderer) renderHTML(status int, setName, tplName, charset string, data interface{}, funcs template.FuncMap, htmlOpt ...macaron.HTMLOptions) {
+	var err error
+	defer r.timeRender(r.opt.HTMLContentType, status, tplName, time.Now(), &err)
+
+	if r.cancelled() {
+		err = r.req.Context().Err()
+		return
+	}
 
-	return out, nil
-}
-
-func (r *renderer) renderHTML(status int, setName, tplName string, data interface{}, htmlOpt ...macaron.HTMLOptions) {
-	//r.startTime = time.Now()
-	//
-	//out, err := r.renderBytes(setName, tplName, data, htmlOpt...)
-	//if err != nil {
-	//	http.Error(r, err.Error(), http.StatusInternalServerError)
-	//	return
-	//}
-	//
-	//r.Header().Set(ContentType, r.opt.HTMLContentType+r.compiledCharset)
-	//r.WriteHeader(status)
-	//
-	//if _, err := out.WriteTo(r); err != nil {
-	//	out.Reset()
-	//}
-	//bufpool.Put(out)
-	//t := r.t[path.Join(setName, tplName)]
-
-	t := r.t[tplName]
-	buf, err := r.execute(t, tplName, data)
+	var out *bytes.Buffer
+	out, err = r.renderBytes(setName, tplName, data, funcs, htmlOpt...)
 	if err != nil {
-		http.Error(r, err.Error(), http.StatusInternalServerError)
+		r.httpError(renderErrorStatus(err), err.Error())
+		return
+	}
+	defer r.bufpool.Put(out)
+
+	// the client may have gone away while the template was executing
+	if r.cancelled() {
+		err = r.req.Context().Err()
 		return
 	}
 
 	// template rendered fine, write out the result
-	r.Header().Set(ContentType, r.opt.HTMLContentType+r.compiledCharset)
-	r.WriteHeader(status)
-	io.Copy(r, buf)
-	bufpool.Put(buf)
+	err = r.writeHTML(status, tplName, r.templateContentType(setName, tplName, charset), out.Bytes())
+}
+
+// RenderTemplate executes the template name of t, e.g. one from Template
+// given funcs of its own, and writes its output like HTML.
+// An empty name executes t itself. Layouts and request funcs like T don't
+// apply, t is rendered as it is, with DataFunc values merged into data.
+// A nil t, like Template returns for an unknown name, fails with a 500.
+func (r *renderer) RenderTemplate(status int, t *template.Template, name string, data interface{}) {
+	if len(name) == 0 && t != nil {
+		name = t.Name()
+	}
+	var err error
+	defer r.timeRender(r.opt.HTMLContentType, status, name, time.Now(), &err)
+
+	if t == nil {
+		err = fmt.Errorf("render: no template to render %q", name)
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if r.cancelled() {
+		err = r.req.Context().Err()
+		return
+	}
+
+	data = r.templateData(data)
+	if err = r.validateData(name, data); err != nil {
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return
+	}
+	var out *bytes.Buffer
+	if out, err = r.execute(htmlTemplate{t}, name, data); err != nil {
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer r.bufpool.Put(out)
+
+	if r.cancelled() {
+		err = r.req.Context().Err()
+		return
+	}
+	err = r.writeHTML(status, name, r.htmlContentType(""), out.Bytes())
 }
 
-//func (r *renderer) HTML(status int, name string, data interface{}, htmlOpt ...macaron.HTMLOptions) {
-//	r.renderHTML(status, defaultTplSetName, name, data, htmlOpt...)
-//}
+// HTMLFragments renders the templates names from the default set one after
+// the other, without layouts, and writes their output as one HTML response.
+// When a fragment fails nothing but a 500 naming that fragment is written.
+func (r *renderer) HTMLFragments(status int, names []string, data interface{}) {
+	var err error
+	defer r.timeRender(r.opt.HTMLContentType, status, strings.Join(names, ","), time.Now(), &err)
+
+	if r.cancelled() {
+		err = r.req.Context().Err()
+		return
+	}
+
+	out := r.bufpool.Get()
+	defer r.bufpool.Put(out)
+	for _, name := range names {
+		if err = r.renderFragment(out, name, data); err != nil {
+			err = fmt.Errorf("render: fragment %s: %w", name, err)
+			r.httpError(http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if r.cancelled() {
+		err = r.req.Context().Err()
+		return
+	}
+	err = r.writeHTML(status, strings.Join(names, ","), r.htmlContentType(""), out.Bytes())
+}
+
+func (r *renderer) renderFragment(out *bytes.Buffer, name string, data interface{}) error {
+	r.bindRequest()
+	data = r.templateData(data)
+	if err := r.validateData(name, data); err != nil {
+		return err
+	}
+	t, err := r.lookup(defaultTplSetName, name, nil)
+	if err != nil {
+		return err
+	}
+	return t.ExecuteTemplate(out, t.Name(), data)
+}
+
+// validateData runs Options.DataValidator on the data of the template name
+func (r *renderer) validateData(name string, data interface{}) error {
+	if r.opt.DataValidator == nil {
+		return nil
+	}
+	if err := r.opt.DataValidator(name, data); err != nil {
+		return fmt.Errorf("render: data of %s rejected: %w", name, err)
+	}
+	return nil
+}
+
+// writeHTML writes a rendered HTML body, without comments and minified when
+// that is enabled and with the security headers set. name is the template
+// reported to Options.CaptureFunc, empty for bodies that aren't templates.
+func (r *renderer) writeHTML(status int, name, contentType string, body []byte) error {
+	body, err := r.finishHTML(contentType, body)
+	if err != nil {
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return err
+	}
+
+	r.setSecurityHeaders()
+	sent, err := r.writeBody(status, contentType, body)
+	if err != nil {
+		return err
+	}
+	if r.opt.CaptureFunc != nil && len(name) > 0 && sent {
+		// body may be the pooled render buffer, which is reused
+		r.opt.CaptureFunc(name, append([]byte(nil), body...))
+	}
+	return nil
+}
+
+// finishHTML strips comments, minifies and self-closes void elements of a
+// rendered body as far as that is enabled
+func (r *renderer) finishHTML(contentType string, body []byte) ([]byte, error) {
+	if r.opt.StripComments {
+		body = stripComments(body, r.opt.StripConditionalComments)
+	}
+	if r.opt.MinifyHTML {
+		var err error
+		if body, err = r.minify(body); err != nil {
+			return nil, err
+		}
+	}
+	if r.opt.SelfCloseVoidElements && isXHTML(contentType) {
+		body = selfCloseVoidElements(body)
+	}
+	return body, nil
+}
+
+// setSecurityHeaders sets Options.SecurityHeaders on the response, leaving
+// headers the handler already set alone
+func (r *renderer) setSecurityHeaders() {
+	r.setMissingHeaders(r.opt.SecurityHeaders)
+	r.setNonceHeader()
+}
+
+// setDefaultHeaders sets Options.DefaultHeaders on the response, leaving
+// headers the handler already set alone. WriteHeader runs it right before the
+// status is written, so anything set earlier in the handler or middleware wins.
+func (r *renderer) setDefaultHeaders() {
+	r.setMissingHeaders(r.opt.DefaultHeaders)
+}
+
+func (r *renderer) setMissingHeaders(headers map[string]string) {
+	for name, value := range headers {
+		if len(r.Header().Values(name)) == 0 {
+			r.Header().Set(name, value)
+		}
+	}
+}
+
+// cancelled reports whether the request's context is done
+func (r *renderer) cancelled() bool {
+	return r.req != nil && r.req.Context().Err() != nil
+}
+
+// lookup returns the template registered as tplName in the set setName, ready
+// to be executed with the funcs added to this renderer and the extra funcs
+func (r *renderer) lookup(setName, tplName string, extra template.FuncMap) (engineTemplate, error) {
+	set, err := r.sets.load(setName)
+	if err != nil {
+		return nil, fmt.Errorf("render: loading set %q: %w", setName, err)
+	}
+	ct := r.compiled(set, tplName)
+	if ct == nil {
+		return nil, fmt.Errorf("html/template: template \"%s\" is undefined", tplName)
+	}
+
+	funcs := r.requestFuncs()
+	if len(funcs) == 0 && len(extra) == 0 {
+		return ct.executable()
+	}
+	t, err := ct.clone()
+	if err != nil {
+		return nil, err
+	}
+	return t.Funcs(funcs).Funcs(extra), nil
+}
+
+// templateMeta returns the front matter of a template, nil when it has none
+func (r *renderer) templateMeta(setName, tplName string) map[string]interface{} {
+	if ct := r.findTemplate(setName, tplName); ct != nil {
+		return ct.meta
+	}
+	return nil
+}
+
+// findTemplate returns the template rendered as tplName from the set
+// setName, nil when there is none
+func (r *renderer) findTemplate(setName, tplName string) *compiledTemplate {
+	set, _ := r.sets.get(setName)
+	return r.compiled(set, tplName)
+}
+
+// templateData merges the Options.DataFunc values of the request into the
+// data of a render. Without data they become the data, a map is copied with
+// its own keys winning and anything else is rendered as is. The values are
+// available through the global func in any case.
+func (r *renderer) templateData(data interface{}) interface{} {
+	if r.opt.DataFunc == nil {
+		return data
+	}
+	global := r.globalData()
+
+	switch d := data.(type) {
+	case nil:
+		return global
+	case map[string]interface{}:
+		merged := make(map[string]interface{}, len(global)+len(d))
+		for k, v := range global {
+			merged[k] = v
+		}
+		for k, v := range d {
+			merged[k] = v
+		}
+		return merged
+	}
+	return data
+}
+
+// globalData calls Options.DataFunc once per request
+func (r *renderer) globalData() map[string]interface{} {
+	r.globalOnce.Do(func() {
+		var global map[string]interface{}
+		if r.req != nil {
+			global = r.opt.DataFunc(r.req)
+		}
+		if global == nil {
+			global = make(map[string]interface{})
+		}
+		r.global = global
+		r.AddFunc("global", func() map[string]interface{} {
+			return global
+		})
+	})
+	return r.global
+}
+
+// AddFunc makes fn available as name to the templates rendered by this
+// request. html/template resolves funcs while parsing, so name must also be
+// declared in Options.Funcs, where a placeholder with the same signature is
+// enough. Rendering with added funcs clones the template first.
+func (r *renderer) AddFunc(name string, fn interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// replace instead of modifying, renders in progress may still use them
+	funcs := make(template.FuncMap, len(r.funcs)+1)
+	for k, v := range r.funcs {
+		funcs[k] = v
+	}
+	funcs[name] = fn
+	r.funcs = funcs
+}
+
+// HTMLWithFuncs renders like HTML with funcs added for this render only, in
+// every template of it, layouts included. Like AddFunc the names must be
+// declared in Options.Funcs, and every template of the render is cloned to
+// get the funcs, which costs a little on each such render.
+func (r *renderer) HTMLWithFuncs(status int, name string, data interface{}, funcs template.FuncMap, htmlOpt ...macaron.HTMLOptions) {
+	r.renderHTML(status, defaultTplSetName, name, "", data, funcs, htmlOpt...)
+}
+
+// requestFuncs returns the funcs added with AddFunc so far
+func (r *renderer) requestFuncs() template.FuncMap {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.funcs
+}
 
 func (r *renderer) HTMLSet(status int, setName, tplName string, data interface{}, htmlOpt ...macaron.HTMLOptions) {
-	r.renderHTML(status, setName, tplName, data, htmlOpt...)
+	r.renderHTML(status, setName, tplName, "", data, nil, htmlOpt...)
 }
 
 func (r *renderer) HTMLSetBytes(setName, tplName string, data interface{}, htmlOpt ...macaron.HTMLOptions) ([]byte, error) {
-	out, err := r.renderBytes(setName, tplName, data, htmlOpt...)
+	out, err := r.renderBytes(setName, tplName, data, nil, htmlOpt...)
 	if err != nil {
 		return []byte(""), err
 	}
-	return out.Bytes(), nil
+	defer r.bufpool.Put(out)
+	// copy, the buffer is reused once it is back in the pool
+	return append([]byte(nil), out.Bytes()...), nil
 }
 
+// HTMLBytes renders the template name from the default set the same way HTML
+// does and returns the output instead of writing it
 func (r *renderer) HTMLBytes(name string, data interface{}, htmlOpt ...macaron.HTMLOptions) ([]byte, error) {
 	return r.HTMLSetBytes(defaultTplSetName, name, data, htmlOpt...)
 }
@@ -330,6 +1781,41 @@ func (r *renderer) HTMLSetString(setName, tplName string, data interface{}, html
 	return string(p), err
 }
 
+// RenderTo renders the template name from the default set like HTML does,
+// layouts included, and writes the output to w instead of the response.
+// Nothing is written to w when rendering fails.
+func (r *renderer) RenderTo(w io.Writer, name string, data interface{}, htmlOpt ...macaron.HTMLOptions) error {
+	out, err := r.renderBytes(defaultTplSetName, name, data, nil, htmlOpt...)
+	if err != nil {
+		return err
+	}
+	defer r.bufpool.Put(out)
+
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// HTMLResult renders the template name from the default set like HTML and
+// returns the body and the status HTML would write instead of writing them:
+// 200 when rendering succeeds, 500 together with the error when it fails,
+// 503 when it took longer than RenderTimeout.
+// The body is the final one, after StripComments and MinifyHTML.
+func (r *renderer) HTMLResult(name string, data interface{}, htmlOpt ...macaron.HTMLOptions) ([]byte, int, error) {
+	out, err := r.renderBytes(defaultTplSetName, name, data, nil, htmlOpt...)
+	if err != nil {
+		return nil, renderErrorStatus(err), err
+	}
+	// copy, the buffer is reused once it is back in the pool
+	body := append([]byte(nil), out.Bytes()...)
+	r.bufpool.Put(out)
+
+	if body, err = r.finishHTML(r.templateContentType(defaultTplSetName, name, ""), body); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return body, http.StatusOK, nil
+}
+
+// HTMLString is HTMLBytes returning a string
 func (r *renderer) HTMLString(name string, data interface{}, htmlOpt ...macaron.HTMLOptions) (string, error) {
 	p, err := r.HTMLBytes(name, data, htmlOpt...)
 	return string(p), err
@@ -337,42 +1823,154 @@ func (r *renderer) HTMLString(name string, data interface{}, htmlOpt ...macaron.
 
 // Error writes the given HTTP status to the current ResponseWriter
 func (r *renderer) Error(status int, message ...string) {
+	msg := ""
+	if len(message) > 0 {
+		msg = message[0]
+	}
+	if r.renderErrorTemplate(status, msg) {
+		return
+	}
+
 	r.WriteHeader(status)
 	if len(message) > 0 {
 		r.Write([]byte(message[0]))
 	}
 }
 
+// httpError answers with the error template of status, or with msg as plain
+// text when there is none or it fails to render
+func (r *renderer) httpError(status int, msg string) {
+	if r.renderErrorTemplate(status, msg) {
+		return
+	}
+	http.Error(r, msg, status)
+}
+
+// renderErrorTemplate renders the Options.ErrorTemplates entry of status with
+// the status and msg as data and reports whether it did
+func (r *renderer) renderErrorTemplate(status int, msg string) bool {
+	name, ok := r.opt.ErrorTemplates[status]
+	if !ok || r.inErrorTemplate {
+		return false
+	}
+	// an error while writing the error page must not render it again
+	r.inErrorTemplate = true
+	defer func() { r.inErrorTemplate = false }()
+
+	out, err := r.renderBytes(defaultTplSetName, name, map[string]interface{}{
+		"Status":  status,
+		"Message": msg,
+	}, nil)
+	if err != nil {
+		if r.opt.Logger != nil {
+			r.opt.Logger.Printf("renders: rendering error template %q: %v", name, err)
+		}
+		return false
+	}
+	defer r.bufpool.Put(out)
+
+	r.writeHTML(status, name, r.templateContentType(defaultTplSetName, name, ""), out.Bytes())
+	return true
+}
+
 func (r *renderer) Status(status int) {
 	r.WriteHeader(status)
 }
 
+// StatusWithText writes status and, unless it is a 2xx status, text as a
+// plain text body. Only the code of the status line can be set: net/http
+// always sends the standard reason phrase for it, "404 Not Found", so a
+// custom reason can only travel in the body.
+func (r *renderer) StatusWithText(status int, text string) {
+	if status >= 200 && status < 300 {
+		r.WriteHeader(status)
+		return
+	}
+	r.writeBody(status, ContentPlain+r.compiledCharset, []byte(text))
+}
+
+// prepareHTMLOptions returns the options of an HTML render, falling back to
+// Options.Layout when the call names no layout
 func (r *renderer) prepareHTMLOptions(htmlOpt []macaron.HTMLOptions) macaron.HTMLOptions {
+	var opt macaron.HTMLOptions
 	if len(htmlOpt) > 0 {
-		return htmlOpt[0]
+		opt = htmlOpt[0]
 	}
-
-	return macaron.HTMLOptions{
-		//Layout: r.opt.Layout,
+	if len(opt.Layout) == 0 {
+		opt.Layout = r.opt.Layout
 	}
+	return opt
 }
 
+// SetTemplatePath adds the templates of dir as the set setName, replacing a
+// set of that name, the default set when setName is empty. Later renders of
+// this request use the new set as well as those of every later request.
+// With Options.LazySets sets other than the default are compiled on first use.
 func (r *renderer) SetTemplatePath(setName, dir string) {
 	if len(setName) == 0 {
 		setName = defaultTplSetName
 	}
-	//opt := r.opt
-	//opt.Directory = dir
-	//r.TemplateSet.Set(setName, &opt)
-	//r.t[path.Join(dir, setName)]
-	log.Println("Calling SetTemplatePath")
+	opt := r.opt
+	opt.Directory = dir
+	opt.Directories = nil
+	// the cache file holds the default set
+	opt.CacheFile = ""
+	l := newLoader(opt)
+	l.text = r.opt.TextMode || r.opt.unescapedSet(setName)
+	var lock sync.Mutex
+	build := func() (templateSet, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return compile(l, opt)
+	}
+	if r.opt.LazySets && setName != defaultTplSetName {
+		r.sets.setLazy(setName, build)
+		return
+	}
+	t, err := build()
+	if err != nil {
+		if r.opt.Logger != nil {
+			r.opt.Logger.Printf("renders: loading set=%q from %s: %v", setName, dir, err)
+		}
+		return
+	}
+	r.sets.add(setName, t, build)
+}
+
+// ReloadSet compiles the set setName again from its directory and swaps it
+// in for every later render, of this request as well, the default set when
+// setName is empty. Other sets and renders already running are unaffected.
+// When the templates fail to compile the error is returned and the old set
+// is kept.
+func (r *renderer) ReloadSet(setName string) error {
+	if len(setName) == 0 {
+		setName = defaultTplSetName
+	}
+	_, err := r.sets.reload(setName)
+	return err
+}
+
+// TemplateNames returns the sorted names of all templates in the default set
+func (r *renderer) TemplateNames() []string {
+	set, _ := r.sets.get(defaultTplSetName)
+	return set.names()
+}
+
+// TemplateSetNames returns the sorted names of all templates in the set
+// setName, nil when there is no such set
+func (r *renderer) TemplateSetNames(setName string) []string {
+	if setName == defaultTplSetName {
+		return r.TemplateNames()
+	}
+	set, ok := r.sets.get(setName)
+	if !ok {
+		return nil
+	}
+	return set.names()
 }
 
 func (r *renderer) HasTemplateSet(name string) bool {
-	//return r.TemplateSet.Get(name) != nil
-	_, ok := r.t[name]
-	return ok
-	//return r.TemplateSet.Get(name) != nil
+	return r.sets.has(name)
 }
 
 func (r *renderer) Redirect(location string, status ...int) {
@@ -384,6 +1982,22 @@ func (r *renderer) Redirect(location string, status ...int) {
 	http.Redirect(r, r.req, location, code)
 }
 
+// Template returns a copy of the html/template of the given name from the
+// default set, nil when there is none or it was parsed with text/template.
+// The copy was never executed, so it can still be cloned and given funcs
+// before rendering it with RenderTemplate.
 func (r *renderer) Template(name string) *template.Template {
-	return r.t[name]
+	if r.opt.CaseInsensitiveNames {
+		name = strings.ToLower(name)
+	}
+	set, _ := r.sets.get(defaultTplSetName)
+	ct := set[name]
+	if ct == nil {
+		return nil
+	}
+	t, _ := ct.clone()
+	if ht, ok := t.(htmlTemplate); ok {
+		return ht.Template
+	}
+	return nil
 }
@@ -0,0 +1,513 @@
+package renders
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oxtoacart/bpool"
+	"gopkg.in/macaron.v1"
+)
+
+// writeTemplates writes files, keyed by their slash separated path, below
+// dir and returns dir
+func writeTemplates(t *testing.T, dir string, files map[string]string) string {
+	t.Helper()
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// testRenderer returns the renderer a request would get from the
+// middleware built with opt, writing to the returned recorder
+func testRenderer(t *testing.T, opt Options) (*renderer, *httptest.ResponseRecorder) {
+	t.Helper()
+	return testHandler(t, opt)()
+}
+
+// testHandler compiles the templates of opt once and returns a func making
+// the renderer of a new request, like the middleware does per request
+func testHandler(t *testing.T, opt Options) func() (*renderer, *httptest.ResponseRecorder) {
+	t.Helper()
+	tpls, err := Precompile(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testHandlerFrom(tpls, opt)
+}
+
+// testHandlerFrom is testHandler for a handler of RendererFromTemplates
+func testHandlerFrom(tpls *Templates, opt Options) func() (*renderer, *httptest.ResponseRecorder) {
+	sets := newTemplateSets()
+	tpls.register(sets)
+
+	opt = prepareOptions([]Options{opt})
+	pool := bpool.NewBufferPool(opt.BufferPoolSize)
+	cs := prepareCharset(opt.Charset)
+	return func() (*renderer, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		return &renderer{
+			ResponseWriter:  rec,
+			req:             httptest.NewRequest(http.MethodGet, "/", nil),
+			sets:            sets,
+			bufpool:         pool,
+			opt:             opt,
+			compiledCharset: cs,
+		}, rec
+	}
+}
+
+func TestHTMLBytesMatchesHTML(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{
+		"index.html":          `<p>{{ .Name }}</p>`,
+		"users/show.html":     `<h1>{{ .Name }}</h1>{{ template "partial.html" . }}`,
+		"partial.html":        `<i>{{ .Name }}</i>`,
+		"layouts/base.html":   `<main>{{ yield }}</main>`,
+		"layouts/outer.html":  `<body>{{ yield }}</body>`,
+		"layouts/define.html": `{{ define "x" }}{{ end }}<div>{{ yield }}</div>`,
+	})
+	data := map[string]string{"Name": "<Gopher>"}
+
+	tests := []struct {
+		name   string
+		layout string
+	}{
+		{"index.html", ""},
+		{"users/show.html", ""},
+		{"index.html", "layouts/base.html"},
+		{"users/show.html", "layouts/outer.html,layouts/base.html"},
+		{"users/show.html", "layouts/define.html"},
+	}
+	for _, test := range tests {
+		r, rec := testRenderer(t, Options{Directory: dir})
+		opt := macaron.HTMLOptions{Layout: test.layout}
+		r.HTML(http.StatusOK, test.name, data, opt)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s with %q: HTML wrote %d: %s", test.name, test.layout, rec.Code, rec.Body)
+		}
+
+		b, err := r.HTMLBytes(test.name, data, opt)
+		if err != nil {
+			t.Fatalf("%s with %q: HTMLBytes: %v", test.name, test.layout, err)
+		}
+		if string(b) != rec.Body.String() {
+			t.Errorf("%s with %q: HTMLBytes %q, HTML %q", test.name, test.layout, b, rec.Body)
+		}
+		s, err := r.HTMLString(test.name, data, opt)
+		if err != nil || s != rec.Body.String() {
+			t.Errorf("%s with %q: HTMLString %q, %v, HTML %q", test.name, test.layout, s, err, rec.Body)
+		}
+	}
+
+	r, _ := testRenderer(t, Options{Directory: dir})
+	if _, err := r.HTMLBytes("missing.html", nil); err == nil {
+		t.Error("HTMLBytes of a missing template: no error")
+	}
+}
+
+// TestConcurrentLayoutRenders is meant for go test -race, the renders share
+// the parsed layout while each adds its own yield and funcs
+func TestConcurrentLayoutRenders(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{
+		"page.html":         `{{ define "title" }}{{ who }}{{ end }}<p>{{ .N }}</p>`,
+		"layouts/base.html": `<title>{{ section "title" }}</title>{{ current }}:{{ yield }}`,
+	})
+	newRequest := testHandler(t, Options{
+		Directory: dir,
+		Layout:    "layouts/base.html",
+		Funcs:     template.FuncMap{"who": func() string { return "" }},
+	})
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			who := "g" + strconv.Itoa(i)
+			want := "<title>" + who + "</title>page.html:<p>" + strconv.Itoa(i) + "</p>"
+
+			r, rec := newRequest()
+			r.AddFunc("who", func() string { return who })
+			r.HTML(http.StatusOK, "page.html", map[string]int{"N": i})
+			if rec.Body.String() != want {
+				t.Errorf("HTML %q, want %q", rec.Body, want)
+			}
+
+			// several goroutines of one request
+			var inner sync.WaitGroup
+			for j := 0; j < 4; j++ {
+				inner.Add(1)
+				go func() {
+					defer inner.Done()
+					out, err := r.HTMLString("page.html", map[string]int{"N": i})
+					if err != nil || out != want {
+						t.Errorf("HTMLString %q, %v, want %q", out, err, want)
+					}
+				}()
+			}
+			inner.Wait()
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{"index.html": `index`})
+	opt := Options{Directory: dir, DefaultHeaders: map[string]string{"X-Req": "1", "X-Set": "default"}}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		render func(r *renderer)
+		status int
+	}{
+		{"HTML", func(r *renderer) { r.HTML(http.StatusOK, "index.html", nil) }, http.StatusOK},
+		{"JSON", func(r *renderer) { r.JSON(http.StatusCreated, 1) }, http.StatusCreated},
+		{"Error", func(r *renderer) { r.Error(http.StatusNotFound) }, http.StatusNotFound},
+		{"Status", func(r *renderer) { r.Status(http.StatusNoContent) }, http.StatusNoContent},
+		{"Redirect", func(r *renderer) { r.Redirect("/x") }, http.StatusFound},
+		{"invalid JSONP callback", func(r *renderer) { r.JSONP(http.StatusOK, "a b", 1) }, http.StatusInternalServerError},
+		{"missing template", func(r *renderer) { r.HTML(http.StatusOK, "missing.html", nil) }, http.StatusInternalServerError},
+		{"HTMLModified 304", func(r *renderer) {
+			r.req.Header.Set("If-Modified-Since", modTime.Format(http.TimeFormat))
+			r.HTMLModified(http.StatusOK, "index.html", modTime, nil)
+		}, http.StatusNotModified},
+		{"Write", func(r *renderer) { r.Write([]byte("x")) }, http.StatusOK},
+	}
+	for _, test := range tests {
+		r, rec := testRenderer(t, opt)
+		r.Header().Set("X-Set", "handler")
+		test.render(r)
+		if rec.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, rec.Code, test.status)
+		}
+		if got := rec.Header().Get("X-Req"); got != "1" {
+			t.Errorf("%s: X-Req %q", test.name, got)
+		}
+		if got := rec.Header().Values("X-Set"); len(got) != 1 || got[0] != "handler" {
+			t.Errorf("%s: X-Set %q, want the handler's", test.name, got)
+		}
+	}
+}
+
+func TestETagMethods(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		method, ifNoneMatch string
+		status              int
+	}{
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodGet, "*", http.StatusNotModified},
+		{http.MethodHead, "*", http.StatusNotModified},
+		{http.MethodPost, "*", http.StatusOK},
+		{http.MethodPut, "*", http.StatusOK},
+	}
+	for _, test := range tests {
+		r, rec := testRenderer(t, Options{Directory: dir, ETag: true})
+		r.req = httptest.NewRequest(test.method, "/", nil)
+		r.req.Header.Set("If-None-Match", test.ifNoneMatch)
+		r.JSON(http.StatusOK, "x")
+		if rec.Code != test.status {
+			t.Errorf("%s with If-None-Match %q: %d, want %d", test.method, test.ifNoneMatch, rec.Code, test.status)
+		}
+		if test.status == http.StatusOK && rec.Body.String() != `"x"` {
+			t.Errorf("%s with If-None-Match %q: body %q", test.method, test.ifNoneMatch, rec.Body)
+		}
+	}
+}
+
+func TestCaptureFuncNotModified(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{"index.html": `index`})
+	var captured []string
+	opt := Options{Directory: dir, ETag: true, CaptureFunc: func(name string, out []byte) {
+		captured = append(captured, name+"="+string(out))
+	}}
+	newRequest := testHandler(t, opt)
+
+	r, rec := newRequest()
+	r.HTML(http.StatusOK, "index.html", nil)
+	etag := rec.Header().Get("ETag")
+
+	r, rec = newRequest()
+	r.req.Header.Set("If-None-Match", etag)
+	r.HTML(http.StatusOK, "index.html", nil)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("second request: %d, want 304", rec.Code)
+	}
+	if len(captured) != 1 || captured[0] != "index.html=index" {
+		t.Errorf("captured %q, want only the first render", captured)
+	}
+}
+
+func TestPanickingFunc(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{"boom.html": `before{{ boom }}after`})
+	funcs := template.FuncMap{"boom": func() string { panic("kaboom") }}
+	r, rec := testRenderer(t, Options{Directory: dir, Funcs: funcs})
+
+	r.HTML(http.StatusOK, "boom.html", nil)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", rec.Code)
+	}
+	if ct := rec.Header().Get(ContentType); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type %q, want a plain error", ct)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "before") || !strings.Contains(body, "kaboom") {
+		t.Errorf("body %q", body)
+	}
+}
+
+func TestSetTemplatePathDefault(t *testing.T) {
+	one := writeTemplates(t, t.TempDir(), map[string]string{"a.html": `one`})
+	two := writeTemplates(t, t.TempDir(), map[string]string{"a.html": `two`})
+	newRequest := testHandler(t, Options{Directory: one})
+
+	r, _ := newRequest()
+	if out, _ := r.HTMLString("a.html", nil); out != "one" {
+		t.Fatalf("before: %q", out)
+	}
+	r.SetTemplatePath("", two)
+	if out, err := r.HTMLString("a.html", nil); err != nil || out != "two" {
+		t.Errorf("same request: %q, %v", out, err)
+	}
+	if names := r.TemplateNames(); len(names) != 1 || names[0] != "a.html" {
+		t.Errorf("TemplateNames %q", names)
+	}
+	r, _ = newRequest()
+	if out, err := r.HTMLString("a.html", nil); err != nil || out != "two" {
+		t.Errorf("later request: %q, %v", out, err)
+	}
+}
+
+func TestRendererPanic(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{"broken.html": `{{ end }}`})
+	defer func() {
+		p := recover()
+		err, ok := p.(error)
+		if !ok {
+			t.Fatalf("panic value %T, want an error", p)
+		}
+		if errors.Unwrap(err) == nil || !strings.Contains(err.Error(), "broken.html") {
+			t.Errorf("%v, want the wrapped compile error", err)
+		}
+	}()
+	Renderer(Options{Directory: dir})
+	t.Error("no panic")
+}
+
+func TestCloneKeepsCompileOptions(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{"users/index.html": `<b>{{ . }}</b>`})
+
+	r, rec := testRenderer(t, Options{Directory: dir, TextMode: true})
+	r.Clone(Options{Charset: "ISO-8859-1"}).HTML(http.StatusOK, "users/index.html", "<script>")
+	if rec.Code != http.StatusOK || rec.Body.String() != "<b><script></b>" {
+		t.Fatalf("TextMode clone: %d %q", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get(ContentType); ct != ContentPlain+"; charset=ISO-8859-1" {
+		t.Errorf("TextMode clone: Content-Type %q, want unescaped output as plain text", ct)
+	}
+
+	r, rec = testRenderer(t, Options{Directory: dir, CaseInsensitiveNames: true})
+	r.Clone(Options{}).HTML(http.StatusOK, "Users/Index.html", "x")
+	if rec.Code != http.StatusOK || rec.Body.String() != "<b>x</b>" {
+		t.Errorf("CaseInsensitiveNames clone: %d %q", rec.Code, rec.Body)
+	}
+}
+
+// statusWriter reports the status written to it, like macaron's ResponseWriter
+type statusWriter struct {
+	*httptest.ResponseRecorder
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func (w *statusWriter) Written() bool { return w.status != 0 }
+func (w *statusWriter) Status() int   { return w.status }
+
+func TestStatusCodeWrittenPastRenderer(t *testing.T) {
+	r, rec := testRenderer(t, Options{Directory: t.TempDir()})
+	w := &statusWriter{ResponseRecorder: rec}
+	r.ResponseWriter = w
+
+	w.WriteHeader(http.StatusNotFound)
+	r.Write([]byte("missing"))
+	if got := r.StatusCode(); got != http.StatusNotFound {
+		t.Errorf("StatusCode %d, want the 404 sent", got)
+	}
+	if got := r.Size(); got != len("missing") {
+		t.Errorf("Size %d", got)
+	}
+}
+
+// TestRenderTimeoutHeaders is meant for go test -race, the render left
+// running after the timeout must not touch the headers of the 503
+func TestRenderTimeoutHeaders(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{
+		"home.html":    `{{ T "hi" }} {{ cspNonce }} {{ .User }}`,
+		"home.fr.html": `{{ T "hi" }} {{ cspNonce }} {{ .User }}`,
+	})
+	newRequest := testHandler(t, Options{
+		Directory:         dir,
+		RenderTimeout:     time.Nanosecond,
+		LocalizeTemplates: true,
+		CSPNonce:          true,
+		Translator:        func(locale, key string, args ...interface{}) string { return locale + ":" + key },
+		DataFunc:          func(*http.Request) map[string]interface{} { return map[string]interface{}{"User": "u"} },
+	})
+
+	for i := 0; i < 20; i++ {
+		r, rec := newRequest()
+		r.req.Header.Set("Accept-Language", "fr-CH")
+		r.HTML(http.StatusOK, "home.html", nil)
+		if rec.Code != http.StatusOK && rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("status %d", rec.Code)
+		}
+		if vary := rec.Header().Get("Vary"); vary != "Accept-Language" {
+			t.Errorf("Vary %q", vary)
+		}
+	}
+}
+
+func TestRenderTimeoutPanic(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{"index.html": `index`})
+	r, rec := testRenderer(t, Options{
+		Directory:     dir,
+		RenderTimeout: time.Minute,
+		DataValidator: func(string, interface{}) error { panic("invalid") },
+	})
+
+	r.HTML(http.StatusOK, "index.html", nil)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", rec.Code)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "invalid") {
+		t.Errorf("body %q, want the panic", body)
+	}
+}
+
+func TestRenderTemplateNil(t *testing.T) {
+	r, rec := testRenderer(t, Options{Directory: t.TempDir()})
+	r.RenderTemplate(http.StatusOK, r.Template("missing.html"), "", nil)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", rec.Code)
+	}
+}
+
+func TestCompressionHead(t *testing.T) {
+	for _, gzip := range []bool{false, true} {
+		headers := map[string]http.Header{}
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			r, rec := testRenderer(t, Options{Directory: t.TempDir(), Compression: true})
+			r.req = httptest.NewRequest(method, "/", nil)
+			if gzip {
+				r.req.Header.Set("Accept-Encoding", "gzip")
+			}
+			r.JSON(http.StatusOK, strings.Repeat("x", 100))
+			if method == http.MethodHead && rec.Body.Len() != 0 {
+				t.Errorf("gzip %v: HEAD body %q", gzip, rec.Body)
+			}
+			headers[method] = rec.Header()
+		}
+		for _, name := range []string{ContentEncoding, ContentLength, "Vary"} {
+			if get, head := headers[http.MethodGet].Get(name), headers[http.MethodHead].Get(name); get != head {
+				t.Errorf("gzip %v: %s of GET %q, of HEAD %q", gzip, name, get, head)
+			}
+		}
+	}
+}
+
+func TestETagHeadMatchesGet(t *testing.T) {
+	opt := Options{Directory: t.TempDir(), ETag: true, Compression: true}
+	newRequest := testHandler(t, opt)
+	request := func(method, ifNoneMatch string) *httptest.ResponseRecorder {
+		r, rec := newRequest()
+		r.req = httptest.NewRequest(method, "/", nil)
+		r.req.Header.Set("Accept-Encoding", "gzip")
+		r.req.Header.Set("If-None-Match", ifNoneMatch)
+		r.JSON(http.StatusOK, "x")
+		return rec
+	}
+
+	head, get := request(http.MethodHead, ""), request(http.MethodGet, "")
+	etag := head.Header().Get("ETag")
+	if etag == "" || etag != get.Header().Get("ETag") {
+		t.Fatalf("ETag of HEAD %q, of GET %q", etag, get.Header().Get("ETag"))
+	}
+	if rec := request(http.MethodGet, etag); rec.Code != http.StatusNotModified {
+		t.Errorf("GET with the ETag of HEAD: %d, want 304", rec.Code)
+	}
+}
+
+func TestMarshalPrefixes(t *testing.T) {
+	r, _ := testRenderer(t, Options{Directory: t.TempDir(), PrefixJSON: []byte(")]}',\n"), PrefixXML: []byte("<!-- x -->")})
+
+	b, err := r.JSONBytes(1)
+	if err != nil || string(b) != ")]}',\n1" {
+		t.Errorf("JSONBytes %q, %v", b, err)
+	}
+	if s, err := r.JSONString(1); err != nil || s != string(b) {
+		t.Errorf("JSONString %q, %v, want JSONBytes %q", s, err, b)
+	}
+
+	type item struct{ N int }
+	b, err = r.XMLBytes(item{1})
+	if err != nil || string(b) != "<!-- x --><item><N>1</N></item>" {
+		t.Errorf("XMLBytes %q, %v", b, err)
+	}
+	if s, err := r.XMLString(item{1}); err != nil || s != string(b) {
+		t.Errorf("XMLString %q, %v, want XMLBytes %q", s, err, b)
+	}
+}
+
+func TestJSONP(t *testing.T) {
+	tests := []struct {
+		callback string
+		status   int
+		body     string
+	}{
+		{"cb", http.StatusOK, `cb({"a":1});`},
+		{"app.on_data1", http.StatusOK, `app.on_data1({"a":1});`},
+		{"a b", http.StatusInternalServerError, ""},
+		{"alert(1)//", http.StatusInternalServerError, ""},
+		{"", http.StatusInternalServerError, ""},
+	}
+	for _, test := range tests {
+		r, rec := testRenderer(t, Options{Directory: t.TempDir()})
+		r.JSONP(http.StatusOK, test.callback, map[string]int{"a": 1})
+		if rec.Code != test.status {
+			t.Errorf("%q: status %d, want %d", test.callback, rec.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			if strings.Contains(rec.Body.String(), `{"a":1}`) {
+				t.Errorf("%q: body %q, want no JSON", test.callback, rec.Body)
+			}
+			continue
+		}
+		if rec.Body.String() != test.body {
+			t.Errorf("%q: body %q, want %q", test.callback, rec.Body, test.body)
+		}
+		if ct := rec.Header().Get(ContentType); ct != ContentJSONP+"; charset=UTF-8" {
+			t.Errorf("%q: Content-Type %q", test.callback, ct)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package renders
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds of the render duration histogram
+var durationBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+type renderKey struct {
+	contentType string
+	status      int
+}
+
+// metrics counts the renders of every request handled by the Renderers of
+// one Templates, each Renderer call has its own
+type metrics struct {
+	lock      sync.Mutex
+	renders   map[renderKey]uint64
+	durations []uint64
+	count     uint64
+	sum       time.Duration
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		renders:   make(map[renderKey]uint64),
+		durations: make([]uint64, len(durationBuckets)),
+	}
+}
+
+func (m *metrics) observe(contentType string, status int, dur time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.renders[renderKey{contentType, status}]++
+	for i, le := range durationBuckets {
+		if dur <= le {
+			m.durations[i]++
+		}
+	}
+	m.count++
+	m.sum += dur
+}
+
+// Stats is a snapshot of the render metrics of a Renderer, shaped so it can
+// be handed to a Prometheus counter vector and const histogram
+type Stats struct {
+	// Renders counts renders by content type, e.g. "application/json", and by
+	// status. A failed render counts as 500.
+	Renders map[string]map[int]uint64
+	// Durations counts the renders that took at most the duration of the
+	// DurationBuckets entry with the same index, so the counts are cumulative
+	DurationBuckets []time.Duration
+	Durations       []uint64
+	// Count and Sum are the number of renders, which includes those slower
+	// than every bucket, and their total duration
+	Count uint64
+	Sum   time.Duration
+}
+
+func (m *metrics) stats() Stats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s := Stats{
+		Renders:         make(map[string]map[int]uint64),
+		DurationBuckets: append([]time.Duration(nil), durationBuckets...),
+		Durations:       append([]uint64(nil), m.durations...),
+		Count:           m.count,
+		Sum:             m.sum,
+	}
+	for k, n := range m.renders {
+		if s.Renders[k.contentType] == nil {
+			s.Renders[k.contentType] = make(map[int]uint64)
+		}
+		s.Renders[k.contentType][k.status] = n
+	}
+	return s
+}
+
+// Stats returns the metrics of all requests handled by this Renderer so
+// far, they are empty unless Options.EnableMetrics is set
+func (r *renderer) Stats() Stats {
+	if r.metrics == nil {
+		return Stats{}
+	}
+	return r.metrics.stats()
+}
+
+// observe records a finished render when metrics are enabled
+func (r *renderer) observe(contentType string, status int, dur time.Duration, err error) {
+	if r.metrics == nil {
+		return
+	}
+	if err != nil {
+		status = http.StatusInternalServerError
+	}
+	r.metrics.observe(contentType, status, dur)
+}
+
+// Stats returns the metrics of every handler made from t with
+// Options.EnableMetrics, summed up. It can be called outside of requests,
+// e.g. by a metrics collector registered at startup.
+func (t *Templates) Stats() Stats {
+	return t.metrics.stats()
+}
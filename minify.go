@@ -0,0 +1,150 @@
+package renders
+
+import "bytes"
+
+// Elements whose content is copied as is by minifyHTML
+var rawElements = [][]byte{
+	[]byte("pre"),
+	[]byte("textarea"),
+	[]byte("script"),
+	[]byte("style"),
+}
+
+// minifyHTML is the default Options.Minifier. It drops comments, except
+// conditional comments, and collapses every run of whitespace between tags
+// into a single space, leaving tags with their attribute values and the
+// content of pre, textarea, script and style elements alone.
+func minifyHTML(src []byte) ([]byte, error) {
+	out := make([]byte, 0, len(src))
+	// whether out ends in a collapsed run, so whitespace on both sides of a
+	// dropped comment becomes a single space as well
+	collapsed := false
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '<' && bytes.HasPrefix(src[i:], []byte("<!--")) && !bytes.HasPrefix(src[i:], []byte("<!--[if")):
+			end := bytes.Index(src[i+4:], []byte("-->"))
+			if end < 0 {
+				return append(out, src[i:]...), nil
+			}
+			i += 4 + end + 3
+		case c == '<':
+			if name := rawElement(src[i+1:]); name != nil {
+				end := indexFold(src[i:], append([]byte("</"), name...))
+				if end < 0 {
+					return append(out, src[i:]...), nil
+				}
+				out = append(out, src[i:i+end]...)
+				i += end
+				collapsed = false
+				continue
+			}
+			// tags are copied as they are, whitespace in quoted attribute
+			// values is data
+			end := -1
+			if isTagStart(src[i+1:]) {
+				end = tagEnd(src[i:])
+			}
+			if end < 0 {
+				out = append(out, c)
+				i++
+			} else {
+				out = append(out, src[i:i+end+1]...)
+				i += end + 1
+			}
+			collapsed = false
+		case isSpace(c):
+			for i < len(src) && isSpace(src[i]) {
+				i++
+			}
+			if !collapsed {
+				out = append(out, ' ')
+			}
+			collapsed = true
+		default:
+			out = append(out, c)
+			i++
+			collapsed = false
+		}
+	}
+	return out, nil
+}
+
+// stripComments drops HTML comments outside of pre, textarea, script and
+// style elements. Conditional comments like <!--[if IE]> are only dropped
+// when conditional is set.
+func stripComments(src []byte, conditional bool) []byte {
+	out := make([]byte, 0, len(src))
+	for i := 0; i < len(src); {
+		if src[i] != '<' {
+			out = append(out, src[i])
+			i++
+			continue
+		}
+		if bytes.HasPrefix(src[i:], []byte("<!--")) && (conditional || !bytes.HasPrefix(src[i:], []byte("<!--[if"))) {
+			end := bytes.Index(src[i+4:], []byte("-->"))
+			if end < 0 {
+				return append(out, src[i:]...)
+			}
+			i += 4 + end + 3
+			continue
+		}
+		if name := rawElement(src[i+1:]); name != nil {
+			end := indexFold(src[i:], append([]byte("</"), name...))
+			if end < 0 {
+				return append(out, src[i:]...)
+			}
+			out = append(out, src[i:i+end]...)
+			i += end
+			continue
+		}
+		out = append(out, '<')
+		i++
+	}
+	return out
+}
+
+// rawElement returns the name of the raw element a tag starts with, or nil
+func rawElement(tag []byte) []byte {
+	for _, name := range rawElements {
+		if len(tag) <= len(name) || !bytes.EqualFold(tag[:len(name)], name) {
+			continue
+		}
+		if next := tag[len(name)]; next == '>' || next == '/' || isSpace(next) {
+			return name
+		}
+	}
+	return nil
+}
+
+// isTagStart reports whether what follows a < starts a tag, an end tag or a
+// declaration like <!DOCTYPE> rather than text like "a < b"
+func isTagStart(src []byte) bool {
+	if len(src) == 0 {
+		return false
+	}
+	c := src[0]
+	return c == '/' || c == '!' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// indexFold is bytes.Index ignoring ASCII case
+func indexFold(s, sep []byte) int {
+	for i := 0; i+len(sep) <= len(s); i++ {
+		if bytes.EqualFold(s[i:i+len(sep)], sep) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// minify runs the rendered HTML through the configured minifier
+func (r *renderer) minify(b []byte) ([]byte, error) {
+	if r.opt.Minifier != nil {
+		return r.opt.Minifier(b)
+	}
+	return minifyHTML(b)
+}
@@ -0,0 +1,27 @@
+package renders
+
+import "testing"
+
+func TestMinifyHTML(t *testing.T) {
+	tests := []struct {
+		src, out string
+	}{
+		{"<p>a   \n b</p>", "<p>a b</p>"},
+		{"<p>\n  <b>x</b>\n</p>", "<p> <b>x</b> </p>"},
+		{`<input value="a   b">`, `<input value="a   b">`},
+		{"<input value='a \n b' title=\"x  y\">  z", "<input value='a \n b' title=\"x  y\"> z"},
+		{`<a title="1 > 0"  href="/">x  y</a>`, `<a title="1 > 0"  href="/">x y</a>`},
+		{"<pre>a   b\n  c</pre>  d", "<pre>a   b\n  c</pre> d"},
+		{"<textarea name=t>a   b</textarea>", "<textarea name=t>a   b</textarea>"},
+		{"<script>if (a  <  b) {\n  f()\n}</script>", "<script>if (a  <  b) {\n  f()\n}</script>"},
+		{"a  <!-- x -->  b", "a b"},
+		{"<!--[if IE]>  x  <![endif]-->", "<!--[if IE]> x <![endif]-->"},
+		{"1  <  2", "1 < 2"},
+	}
+	for _, test := range tests {
+		out, err := minifyHTML([]byte(test.src))
+		if err != nil || string(out) != test.out {
+			t.Errorf("minifyHTML(%q) = %q, %v, want %q", test.src, out, err, test.out)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+//go:build msgpack
+// +build msgpack
+
+package renders
+
+import (
+	"net/http"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/macaron.v1"
+)
+
+// ContentMsgPack is only available when building with the msgpack tag, which
+// keeps the MessagePack dependency optional.
+const ContentMsgPack = "application/msgpack"
+
+// MsgPackRender is Render with MsgPack, the middleware injects it as well
+// when building with the msgpack tag
+type MsgPackRender interface {
+	Render
+
+	MsgPack(status int, v interface{})
+}
+
+var _ MsgPackRender = (*renderer)(nil)
+
+// mapMsgPack injects the renderer of the request as a MsgPackRender
+func mapMsgPack(c *macaron.Context, r *renderer) {
+	c.MapTo(r, (*MsgPackRender)(nil))
+}
+
+func (r *renderer) MsgPack(status int, v interface{}) {
+	result, err := msgpack.Marshal(v)
+	if err != nil {
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// msgpack rendered fine, write out the result
+	r.writeBody(status, ContentMsgPack, result)
+}
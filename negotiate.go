@@ -0,0 +1,124 @@
+package renders
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatJSON = "json"
+	formatXML  = "xml"
+	formatHTML = "html"
+)
+
+// Media types Negotiate can answer with, in order of preference for wildcards
+var negotiableTypes = []struct {
+	mediaType string
+	format    string
+}{
+	{ContentJSON, formatJSON},
+	{ContentHTML, formatHTML},
+	{ContentXHTML, formatHTML},
+	{"application/xml", formatXML},
+	{ContentXML, formatXML},
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept returns the media ranges of an Accept header ordered by
+// quality, ranges with equal quality keep the order of the header. Ranges
+// refused with q=0 are kept, they exclude what a wildcard would allow.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(mediaType) == 0 {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+				q = v
+			}
+		}
+		if q < 0 {
+			q = 0
+		}
+		ranges = append(ranges, acceptRange{mediaType, q})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	return ranges
+}
+
+// specificity ranks how closely mediaRange matches mediaType, 2 for the
+// type itself, 1 for type/*, 0 for */* and -1 when it doesn't match
+func specificity(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 2
+	case mediaRange == "*/*":
+		return 0
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, mediaRange[:len(mediaRange)-1]):
+		return 1
+	}
+	return -1
+}
+
+// negotiateFormat picks the format to answer a request with the given Accept
+// header, JSON when nothing acceptable matches. The most specific range
+// matching a type decides its quality (RFC 9110 section 12.5.1), so a type
+// refused with q=0 stays refused under a wildcard. Equal qualities go to the
+// more specific range, then to the range listed first.
+func negotiateFormat(accept string) string {
+	ranges := parseAccept(accept)
+	format, bestQ, bestSpec, bestIdx := formatJSON, 0.0, -1, len(ranges)
+	for _, nt := range negotiableTypes {
+		q, spec, idx := 0.0, -1, len(ranges)
+		for i, ar := range ranges {
+			if s := specificity(ar.mediaType, nt.mediaType); s > spec {
+				q, spec, idx = ar.q, s, i
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		if q > bestQ || q == bestQ && (spec > bestSpec || spec == bestSpec && idx < bestIdx) {
+			format, bestQ, bestSpec, bestIdx = nt.format, q, spec, idx
+		}
+	}
+	return format
+}
+
+// Negotiate renders v as JSON or XML, or the template htmlName with data as
+// HTML, depending on the request's Accept header. Types with equal quality
+// are chosen by the more specific range, then in the order the client listed
+// them. */*, an empty header or no acceptable type at all render JSON.
+func (r *renderer) Negotiate(status int, v interface{}, htmlName string, data interface{}) {
+	accept := ""
+	if r.req != nil {
+		accept = r.req.Header.Get("Accept")
+	}
+	r.vary("Accept")
+
+	switch negotiateFormat(accept) {
+	case formatXML:
+		r.XML(status, v)
+	case formatHTML:
+		r.HTML(status, htmlName, data)
+	default:
+		r.JSON(status, v)
+	}
+}
@@ -0,0 +1,30 @@
+package renders
+
+import "testing"
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept, format string
+	}{
+		{"", formatJSON},
+		{"*/*", formatJSON},
+		{"text/html", formatHTML},
+		{"text/html, application/xml", formatHTML},
+		{"application/xml, text/html", formatXML},
+		{"text/*, application/json", formatJSON},
+		{"application/json;q=0.5, text/html;q=0.8", formatHTML},
+		{"text/*;q=0.5, text/xml;q=0.5", formatXML},
+		{"*/*;q=0.8, text/html;q=0.8", formatHTML},
+		{"application/json;q=0, */*", formatHTML},
+		{"application/json;q=0, text/html;q=0, application/xhtml+xml;q=0, */*", formatXML},
+		{"text/*;q=0, */*;q=0.5", formatJSON},
+		{"text/html;q=0, text/*", formatXML},
+		{"text/html;q=0", formatJSON},
+		{"image/png", formatJSON},
+	}
+	for _, test := range tests {
+		if format := negotiateFormat(test.accept); format != test.format {
+			t.Errorf("negotiateFormat(%q) = %s, want %s", test.accept, format, test.format)
+		}
+	}
+}
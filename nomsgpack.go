@@ -0,0 +1,9 @@
+//go:build !msgpack
+// +build !msgpack
+
+package renders
+
+import "gopkg.in/macaron.v1"
+
+// mapMsgPack does nothing without the msgpack build tag, see msgpack.go
+func mapMsgPack(c *macaron.Context, r *renderer) {}
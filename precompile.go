@@ -0,0 +1,137 @@
+package renders
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/macaron.v1"
+)
+
+// Templates holds the compiled default set of a Precompile call, safe to
+// share between several handlers made by RendererFromTemplates
+type Templates struct {
+	opt    Options
+	reload bool
+	// shared by the handlers with EnableMetrics, see Stats
+	metrics *metrics
+
+	// checkLock guards checked, when refresh last looked for changed files
+	checkLock sync.Mutex
+	checked   time.Time
+
+	// lock guards everything below, a loader must not run twice at once
+	lock sync.Mutex
+	l    *loader
+	set  templateSet
+	// the sets of every handler sharing the templates
+	handlers []*templateSets
+}
+
+// Precompile walks and parses the templates described by opt once. The
+// result is handed to RendererFromTemplates, so several handlers share one
+// parsed set instead of every Renderer call parsing the templates again.
+func Precompile(opt Options) (*Templates, error) {
+	opt = prepareOptions([]Options{opt})
+	t := &Templates{
+		opt:     opt,
+		reload:  opt.ReloadOnChange || macaron.Env == macaron.DEV,
+		l:       newLoader(opt),
+		metrics: newMetrics(),
+	}
+	if _, err := t.build(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// build compiles the templates again and swaps them in for every handler
+// sharing t, except those whose default set was replaced with SetTemplatePath
+func (t *Templates) build() (templateSet, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.compile()
+}
+
+func (t *Templates) compile() (templateSet, error) {
+	set, err := compile(t.l, t.opt)
+	if err != nil {
+		return nil, err
+	}
+	t.set = set
+	for _, sets := range t.handlers {
+		sets.addShared(defaultTplSetName, set, t.build)
+	}
+	return set, nil
+}
+
+// ReloadSet compiles the set setName again and swaps it in for every handler
+// sharing t, like the ReloadSet of their renderers but without a request.
+// The default set is compiled once for all of them when setName is empty,
+// a set added with SetTemplatePath is reloaded in every handler that has it.
+// The first error is returned, a set failing to compile keeps its old one.
+func (t *Templates) ReloadSet(setName string) error {
+	if len(setName) == 0 || setName == defaultTplSetName {
+		_, err := t.build()
+		return err
+	}
+
+	t.lock.Lock()
+	handlers := append([]*templateSets(nil), t.handlers...)
+	t.lock.Unlock()
+
+	found := false
+	var firstErr error
+	for _, sets := range handlers {
+		if !sets.has(setName) {
+			continue
+		}
+		found = true
+		if _, err := sets.reload(setName); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if !found {
+		return fmt.Errorf("render: no template set %q", setName)
+	}
+	return firstErr
+}
+
+// refreshInterval is how often refresh looks for changed template files at
+// most
+const refreshInterval = time.Second
+
+// refresh recompiles the templates when a template file changed, a failed
+// compile is logged and keeps the old set. Walking the template files takes
+// the lock, so only one request per refreshInterval does it and the others
+// render right away.
+func (t *Templates) refresh() {
+	t.checkLock.Lock()
+	if time.Since(t.checked) < refreshInterval {
+		t.checkLock.Unlock()
+		return
+	}
+	t.checked = time.Now()
+	t.checkLock.Unlock()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.l.changed() {
+		return
+	}
+	if _, err := t.compile(); err != nil && t.opt.Logger != nil {
+		t.opt.Logger.Printf("renders: recompiling templates: %v", err)
+	}
+}
+
+// register adds the current set to the sets of a handler, which get every
+// later compile as well
+func (t *Templates) register(sets *templateSets) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	sets.addShared(defaultTplSetName, t.set, t.build)
+	t.handlers = append(t.handlers, sets)
+}
@@ -0,0 +1,151 @@
+package renders
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTemplatesReloadSet(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{"a.html": `one`})
+	mails := writeTemplates(t, t.TempDir(), map[string]string{"m.html": `one`})
+	// without ReloadOnChange only a reload picks up the edits
+	opt := Options{Directory: dir}
+	tpls, err := Precompile(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := testHandlerFrom(tpls, opt), testHandlerFrom(tpls, opt)
+	r, _ := first()
+	r.SetTemplatePath("mails", mails)
+
+	writeTemplates(t, dir, map[string]string{"a.html": `two`})
+	writeTemplates(t, mails, map[string]string{"m.html": `two`})
+	if err := tpls.ReloadSet(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := tpls.ReloadSet("mails"); err != nil {
+		t.Fatal(err)
+	}
+	for i, newRequest := range []func() (*renderer, *httptest.ResponseRecorder){first, second} {
+		r, _ := newRequest()
+		if out, err := r.HTMLString("a.html", nil); err != nil || out != "two" {
+			t.Errorf("handler %d: %q, %v", i, out, err)
+		}
+	}
+	r, _ = first()
+	if out, err := r.HTMLSetString("mails", "m.html", nil); err != nil || out != "two" {
+		t.Errorf("mails: %q, %v", out, err)
+	}
+
+	if err := tpls.ReloadSet("missing"); err == nil {
+		t.Error("reloading a missing set: no error")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.html"), []byte(`{{ end }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := tpls.ReloadSet(""); err == nil {
+		t.Error("reloading a broken set: no error")
+	}
+	r, _ = second()
+	if out, err := r.HTMLString("a.html", nil); err != nil || out != "two" {
+		t.Errorf("after a failed reload: %q, %v", out, err)
+	}
+}
+
+// TestReloadSetConcurrentRenders is meant for go test -race
+func TestReloadSetConcurrentRenders(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{"a.html": `a`})
+	r, _ := testRenderer(t, Options{Directory: dir})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if out, err := r.HTMLString("a.html", nil); err != nil || out != "a" {
+				t.Errorf("HTMLString %q, %v", out, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := r.ReloadSet(""); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRefreshInterval(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{"a.html": `one`})
+	opt := Options{Directory: dir, ReloadOnChange: true}
+	tpls, err := Precompile(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRequest := testHandlerFrom(tpls, opt)
+	edit := func(src string, modTime time.Time) {
+		writeTemplates(t, dir, map[string]string{"a.html": src})
+		if err := os.Chtimes(filepath.Join(dir, "a.html"), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	render := func() string {
+		tpls.refresh()
+		r, _ := newRequest()
+		out, err := r.HTMLString("a.html", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	edit(`two`, time.Now().Add(-time.Hour))
+	if out := render(); out != "two" {
+		t.Errorf("first check: %q", out)
+	}
+	edit(`three`, time.Now().Add(-time.Minute))
+	if out := render(); out != "two" {
+		t.Errorf("within the interval: %q, want no check", out)
+	}
+	tpls.checked = time.Now().Add(-refreshInterval)
+	if out := render(); out != "three" {
+		t.Errorf("after the interval: %q", out)
+	}
+}
+
+func TestRefreshKeepsSetTemplatePath(t *testing.T) {
+	one := writeTemplates(t, t.TempDir(), map[string]string{"a.html": `one`})
+	two := writeTemplates(t, t.TempDir(), map[string]string{"a.html": `two`})
+	opt := Options{Directory: one, ReloadOnChange: true}
+	tpls, err := Precompile(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, other := testHandlerFrom(tpls, opt), testHandlerFrom(tpls, opt)
+	r, _ := replaced()
+	r.SetTemplatePath("", two)
+
+	writeTemplates(t, one, map[string]string{"a.html": `edited`})
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(one, "a.html"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	tpls.refresh()
+	if err := tpls.ReloadSet(""); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ = replaced()
+	if out, err := r.HTMLString("a.html", nil); err != nil || out != "two" {
+		t.Errorf("SetTemplatePath handler: %q, %v", out, err)
+	}
+	r, _ = other()
+	if out, err := r.HTMLString("a.html", nil); err != nil || out != "edited" {
+		t.Errorf("other handler: %q, %v", out, err)
+	}
+}
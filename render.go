@@ -0,0 +1,70 @@
+package renders
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Render writes v encoded for contentType with the method of that type, so
+// their options apply: JSON, XML, YAML, TOML, CSV for [][]string and plain
+// text, which writes strings and []byte as they are and anything else with
+// fmt.Sprint. JSON and XML subtypes like application/problem+json are sent
+// with contentType itself. A []byte of any other type is written as is,
+// like DataWithType, and anything else is a 500.
+func (r *renderer) Render(status int, contentType string, v interface{}) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		r.httpError(http.StatusInternalServerError, fmt.Sprintf("render: invalid content type %q: %v", contentType, err))
+		return
+	}
+
+	switch {
+	case mediaType == ContentJSON:
+		r.JSON(status, v)
+	case strings.HasSuffix(mediaType, "+json"):
+		r.encoded(status, contentType, r.JSONBytes, v)
+	case mediaType == ContentXML:
+		r.XML(status, v)
+	case mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml"):
+		r.encoded(status, contentType, r.XMLBytes, v)
+	case mediaType == ContentYAML || mediaType == "application/yaml" || mediaType == "text/yaml":
+		r.YAML(status, v)
+	case mediaType == ContentTOML:
+		r.TOML(status, v)
+	case mediaType == ContentCSV:
+		records, ok := v.([][]string)
+		if !ok {
+			r.httpError(http.StatusInternalServerError, fmt.Sprintf("render: CSV needs [][]string, got %T", v))
+			return
+		}
+		r.CSV(status, records)
+	case mediaType == ContentPlain:
+		switch p := v.(type) {
+		case string:
+			r.PlainString(status, p)
+		case []byte:
+			r.PlainText(status, p)
+		default:
+			r.PlainString(status, fmt.Sprint(v))
+		}
+	default:
+		b, ok := v.([]byte)
+		if !ok {
+			r.httpError(http.StatusInternalServerError, fmt.Sprintf("render: no encoder for content type %q", contentType))
+			return
+		}
+		r.DataWithType(status, contentType, b)
+	}
+}
+
+// encoded writes v encoded by encode as contentType
+func (r *renderer) encoded(status int, contentType string, encode func(interface{}) ([]byte, error), v interface{}) {
+	result, err := encode(v)
+	if err != nil {
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return
+	}
+	r.DataWithType(status, contentType, result)
+}
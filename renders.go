@@ -1,74 +1,357 @@
 package renders
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
+	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
-	"sync"
+	"time"
 )
 
-var (
-	cache               []*namedTemplate
-	regularTemplateDefs []string
-	basePath            string
-	exts                []string
-	lock                sync.Mutex
-	reDefineTag         = regexp.MustCompile("{{ ?define \"([^\"]*)\" ?\"?([a-zA-Z0-9]*)?\"? ?}}")
-	reTemplateTag       = regexp.MustCompile("{{ ?template \"([^\"]*)\" ?([^ ]*)? ?}}")
+var errTemplatesChanged = errors.New("render: templates changed")
+
+// layoutFuncs are declared on every template so layouts parse, renders with a
+// layout replace them on a clone of the layout
+var layoutFuncs = template.FuncMap{
+	"yield": func() (template.HTML, error) {
+		return "", errors.New("render: yield called with no layout defined")
+	},
+	"current": func() (string, error) {
+		return "", nil
+	},
+	"section": func(string) (template.HTML, error) {
+		return "", nil
+	},
+	"global": func() map[string]interface{} {
+		return nil
+	},
+	"T": func(key string, args ...interface{}) string {
+		return key
+	},
+	"cspNonce": func() (string, error) {
+		return "", nil
+	},
+	// flush only sends anything when rendered by HTMLStream
+	"flush": func() (string, error) {
+		return "", nil
+	},
+}
+
+const (
+	defaultLeftDelim  = "{{"
+	defaultRightDelim = "}}"
 )
 
+// defineTagRegexp matches {{ define "name" }} tags written with the given
+// delimiters, including trim markers and any whitespace or newlines between
+// the tokens, e.g. {{- define "name" -}}
+func defineTagRegexp(left, right string) *regexp.Regexp {
+	return regexp.MustCompile(regexp.QuoteMeta(left) + `-?\s*define\s+"([^"]*)"\s*-?` + regexp.QuoteMeta(right))
+}
+
+// templateTagRegexp matches {{ template "name" . }} tags written with the given
+// delimiters, with the same tolerance for trim markers and whitespace
+func templateTagRegexp(left, right string) *regexp.Regexp {
+	return regexp.MustCompile(`(?s)` + regexp.QuoteMeta(left) + `-?\s*template\s+"([^"]*)".*?` + regexp.QuoteMeta(right))
+}
+
 type namedTemplate struct {
 	Name string
+	// Path of the template file, as passed to file_content
+	Path string
 	Src  string
 }
 
-// Load prepares and parses all templates from the passed basePath
-func Load(opt Options) (map[string]*template.Template, error) {
-	basePath = opt.Directory
-	exts = opt.Extensions
-	return loadTemplates(nil)
+// loader holds the state of a single template loading run, so that
+// concurrent loads of different directories never share anything
+type loader struct {
+	cache               []*namedTemplate
+	regularTemplateDefs []string
+	// all template roots in load order, basePath is the one currently walked
+	dirs     []string
+	basePath string
+	exts     []string
+	// parse with text/template instead of html/template
+	text bool
+	// transforms the source of every file before it is cached, may be nil
+	preprocess func(name, src string) (string, error)
+	// strip front matter from every source, keeping that of each loaded file
+	frontMatter bool
+	meta        map[string]map[string]interface{}
+	pageMeta    map[string]interface{}
+	// fail on template tags that nothing resolves
+	strictPartials bool
+	// load empty template files as empty templates instead of failing
+	allowEmpty bool
+	// derives the registered name from the relative path, may be nil
+	nameFunc func(string) string
+	// register templates by their lower cased name
+	caseInsensitive bool
+	// fail on a template name found in more than one root instead of letting the later root win
+	duplicatesError bool
+	// when set templates are read from fsys instead of the disk
+	fsys fs.FS
+	// descend into symlinked directories on the disk
+	followSymlinks bool
+	// template action delimiters and the tag expressions built from them
+	leftDelim     string
+	rightDelim    string
+	reDefineTag   *regexp.Regexp
+	reTemplateTag *regexp.Regexp
+	// modification times of every template file seen by the last run
+	modTimes map[string]time.Time
+	// paths of every template file by name across all roots, the later root
+	// wins like it does for the registered templates
+	files map[string]string
+	// where the prepared sources are kept between runs, may be empty
+	cacheFile string
+	logger    *log.Logger
 }
 
-// LoadWithFuncMap prepares and parses all templates from the passed basePath and injects
-// a custom template.FuncMap into each template
-func LoadWithFuncMap(opt Options) (map[string]*template.Template, error) {
-	basePath = opt.Directory
-	exts = opt.Extensions
-	return loadTemplates(opt.Funcs)
+func newLoader(opt Options) *loader {
+	left, right := opt.LeftDelim, opt.RightDelim
+	if len(left) == 0 {
+		left = defaultLeftDelim
+	}
+	if len(right) == 0 {
+		right = defaultRightDelim
+	}
+
+	dirs := opt.Directories
+	if len(dirs) == 0 {
+		dirs = []string{opt.Directory}
+	}
+
+	return &loader{
+		dirs:            dirs,
+		basePath:        dirs[0],
+		duplicatesError: opt.DuplicateNamesError,
+		nameFunc:        opt.NameFunc,
+		caseInsensitive: opt.CaseInsensitiveNames,
+		strictPartials:  opt.StrictPartials,
+		allowEmpty:      opt.AllowEmptyTemplates,
+		preprocess:      opt.Preprocess,
+		frontMatter:     opt.FrontMatter,
+		exts:            opt.Extensions,
+		fsys:            opt.FileSystem,
+		followSymlinks:  opt.FollowSymlinks,
+		text:            opt.TextMode,
+		cacheFile:       opt.CacheFile,
+		logger:          opt.Logger,
+		leftDelim:       left,
+		rightDelim:      right,
+		reDefineTag:     defineTagRegexp(left, right),
+		reTemplateTag:   templateTagRegexp(left, right),
+	}
+}
+
+// walk calls fn for every file below each root that matches one of the
+// configured extensions, fi may be nil if the file could not be stat'ed.
+// While fn runs basePath is set to the root the file was found in.
+//
+// The roots come in the configured order. Within a root the files come in
+// the order of their slash separated path relative to it, compared element
+// by element, whatever order the file system lists them in: "a/b.html"
+// before "a/c/d.html" before "a/e.html" before "b.html".
+func (l *loader) walk(fn func(path string, fi os.FileInfo) error) error {
+	type file struct {
+		name, path string
+		fi         os.FileInfo
+	}
+	for _, dir := range l.dirs {
+		l.basePath = dir
+		var files []file
+		if err := l.walkBase(func(path string, fi os.FileInfo) error {
+			files = append(files, file{generateTemplateName(dir, path), path, fi})
+			return nil
+		}); err != nil {
+			return err
+		}
+		sort.SliceStable(files, func(i, j int) bool {
+			return lessPath(files[i].name, files[j].name)
+		})
+		for _, f := range files {
+			if err := fn(f.path, f.fi); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func loadTemplates(funcMap template.FuncMap) (map[string]*template.Template, error) {
-	lock.Lock()
-	defer lock.Unlock()
+func (l *loader) walkBase(fn func(path string, fi os.FileInfo) error) error {
+	if l.fsys != nil {
+		return fs.WalkDir(l.fsys, l.basePath, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !inExtensions(l.exts, path.Ext(p)) {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return fn(p, fi)
+		})
+	}
 
-	templates := make(map[string]*template.Template)
+	if l.followSymlinks {
+		if real, err := filepath.EvalSymlinks(l.basePath); err == nil {
+			return l.walkLinks(l.basePath, real, nil, fn)
+		}
+	}
 
-	err := filepath.Walk(basePath, func(path string, fi os.FileInfo, err error) error {
-		r, err := filepath.Rel(basePath, path)
+	return filepath.Walk(l.basePath, func(path string, fi os.FileInfo, err error) error {
+		r, err := filepath.Rel(l.basePath, path)
 		if err != nil {
 			return err
 		}
 
 		ext := filepath.Ext(r)
 
-		if !inExtensions(ext) {
+		if !inExtensions(l.exts, ext) {
 			return nil
 		}
-		if err := add(path); err != nil {
-			panic(err)
+		return fn(path, fi)
+	})
+}
+
+// walkLinks walks the directory real as if it were at root, descending into
+// symlinked directories. A link to a directory that is being walked already,
+// directly or through the roots of the walks it is nested in, is skipped.
+// Symlinked files are passed with the FileInfo of their target.
+func (l *loader) walkLinks(root, real string, outer []string, fn func(path string, fi os.FileInfo) error) error {
+	outer = append(outer, real)
+	return filepath.Walk(real, func(p string, fi os.FileInfo, err error) error {
+		rel, err := filepath.Rel(real, p)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(root, rel)
+
+		if fi != nil && fi.Mode()&os.ModeSymlink != 0 {
+			if target, err := filepath.EvalSymlinks(p); err == nil {
+				if tfi, err := os.Stat(target); err == nil {
+					if tfi.IsDir() {
+						if withinDir(filepath.Dir(p), target) || anyWithinDir(outer, target) {
+							return nil
+						}
+						return l.walkLinks(path, target, outer, fn)
+					}
+					fi = tfi
+				}
+			}
+		}
+
+		if !inExtensions(l.exts, filepath.Ext(rel)) {
+			return nil
+		}
+		return fn(path, fi)
+	})
+}
+
+// changed reports whether any template file was added, removed or modified
+// since the last call to loadTemplates
+func (l *loader) changed() bool {
+	if l.modTimes == nil {
+		return true
+	}
+
+	seen := 0
+	err := l.walk(func(path string, fi os.FileInfo) error {
+		if fi == nil {
+			return errTemplatesChanged
+		}
+		if mt, ok := l.modTimes[path]; !ok || !mt.Equal(fi.ModTime()) {
+			return errTemplatesChanged
+		}
+		seen++
+		return nil
+	})
+
+	return err != nil || seen != len(l.modTimes)
+}
+
+// errLoadTextMode fails Load and LoadWithFuncMap, whose templates are all
+// parsed with text/template under Options.TextMode
+var errLoadTextMode = errors.New("render: Load returns html/template only, use Precompile for TextMode")
+
+// Load prepares and parses all templates from the passed basePath. It only
+// returns html/template templates, so it fails with Options.TextMode.
+func Load(opt Options) (map[string]*template.Template, error) {
+	if opt.TextMode {
+		return nil, errLoadTextMode
+	}
+	t, err := newLoader(opt).loadTemplates(nil)
+	return htmlTemplates(t), err
+}
+
+// LoadWithFuncMap prepares and parses all templates from the passed basePath and injects
+// a custom template.FuncMap into each template. Like Load it fails with
+// Options.TextMode.
+func LoadWithFuncMap(opt Options) (map[string]*template.Template, error) {
+	if opt.TextMode {
+		return nil, errLoadTextMode
+	}
+	t, err := newLoader(opt).loadTemplates(opt.Funcs)
+	return htmlTemplates(t), err
+}
+
+func (l *loader) loadTemplates(funcMap template.FuncMap) (map[string]engineTemplate, error) {
+	exts, err := prepareExtensions(l.exts)
+	if err != nil {
+		return nil, err
+	}
+	l.exts = exts
+
+	l.reset()
+	if len(l.cacheFile) > 0 {
+		if templates, ok, err := l.loadCache(funcMap); ok {
+			return templates, err
+		}
+		l.reset()
+	}
+
+	templates := make(map[string]engineTemplate)
+	var (
+		refs   = newTemplateRefs()
+		cached []cachedTemplate
+	)
+
+	// Index the files of every root first, so includes can name a template
+	// of another root
+	l.walk(func(path string, fi os.FileInfo) error {
+		if fi != nil {
+			l.files[generateTemplateName(l.basePath, path)] = path
+		}
+		return nil
+	})
+
+	err = l.walk(func(path string, fi os.FileInfo) error {
+		if fi != nil {
+			l.modTimes[path] = fi.ModTime()
+		}
+		l.pageMeta = nil
+		if err := l.add(generateTemplateName(l.basePath, path), path); err != nil {
+			return fmt.Errorf("render: loading %s: %w", path, err)
 		}
 
 		// Now we find all regular template definitions and check for the most recent definition
-		for _, t := range regularTemplateDefs {
+		for _, t := range l.regularTemplateDefs {
 			found := false
 			defineIdx := 0
 			// From the beginning (which should) most specfic we look for definitions
-			for _, nt := range cache {
-				nt.Src = reDefineTag.ReplaceAllStringFunc(nt.Src, func(raw string) string {
-					parsed := reDefineTag.FindStringSubmatch(raw)
+			for _, nt := range l.cache {
+				nt.Src = l.reDefineTag.ReplaceAllStringFunc(nt.Src, func(raw string) string {
+					parsed := l.reDefineTag.FindStringSubmatch(raw)
 					name := parsed[1]
 					if name != t {
 						return raw
@@ -81,51 +364,161 @@ func loadTemplates(funcMap template.FuncMap) (map[string]*template.Template, err
 
 					defineIdx++
 
-					return fmt.Sprintf("{{ define \"%s_invalidated_#%d\" }}", name, defineIdx)
+					// Only rename, so trim markers and formatting stay as written
+					return strings.Replace(raw, `"`+name+`"`, fmt.Sprintf(`"%s_invalidated_#%d"`, name, defineIdx), 1)
 				})
 			}
 		}
 
-		var (
-			baseTmpl *template.Template
-			i        int
-		)
-
-		for _, nt := range cache {
-			var currentTmpl *template.Template
-			if i == 0 {
-				baseTmpl = template.New(nt.Name)
-				currentTmpl = baseTmpl
-			} else {
-				currentTmpl = baseTmpl.New(nt.Name)
-			}
-
-			template.Must(currentTmpl.Funcs(funcMap).Parse(nt.Src))
-			i++
+		baseTmpl, err := l.parse(funcMap)
+		if err != nil {
+			return err
+		}
+		if l.strictPartials {
+			l.collectReferences(baseTmpl, refs)
+		}
+		tname := l.templateKey(path)
+		if _, ok := templates[tname]; ok && l.duplicatesError {
+			return fmt.Errorf("render: template %s in %s is already defined by an earlier directory", tname, l.basePath)
 		}
-		tname := generateTemplateName(basePath, path)
 		templates[tname] = baseTmpl
+		if l.pageMeta != nil {
+			l.meta[tname] = l.pageMeta
+		} else {
+			delete(l.meta, tname)
+		}
+		if len(l.cacheFile) > 0 {
+			ct, err := l.cachedTemplate(tname)
+			if err != nil {
+				return err
+			}
+			cached = append(cached, ct)
+		}
 
 		// Make sure we empty the cache between runs
-		cache = cache[0:0]
+		l.cache = l.cache[0:0]
 		return nil
 	})
 
+	var dangling []string
+	if err == nil && l.strictPartials {
+		dangling = refs.dangling(func(name string) bool {
+			_, file := l.files[name]
+			_, ok := templates[name]
+			return file || ok
+		})
+	}
+	if err == nil && len(dangling) > 0 {
+		err = fmt.Errorf("render: unresolved template references:\n\t%s", strings.Join(dangling, "\n\t"))
+	}
+	if err == nil && len(l.cacheFile) > 0 {
+		// the cache only speeds up the next start, failing to write it is no reason to fail this one
+		if err := l.saveCache(cached); err != nil && l.logger != nil {
+			l.logger.Printf("renders: writing template cache %s: %v", l.cacheFile, err)
+		}
+	}
 	return templates, err
 }
 
-func add(path string) error {
+// reset starts from a clean state, the same loader may be used for several runs
+func (l *loader) reset() {
+	l.cache = l.cache[0:0]
+	l.regularTemplateDefs = l.regularTemplateDefs[0:0]
+	l.modTimes = make(map[string]time.Time)
+	l.files = make(map[string]string)
+	l.meta = make(map[string]map[string]interface{})
+}
+
+// templateRefs collects, for StrictPartials, the template tags that the
+// parse of their own file doesn't resolve. Most of them name a define of
+// another file, e.g. the "body" a layout leaves to the pages extending it,
+// so they can only be judged once every file is loaded.
+type templateRefs struct {
+	// "path: name" of every tag not resolved by its own file
+	unresolved []string
+	names      map[string]string
+	// names defined by any loaded source
+	defined map[string]bool
+}
+
+func newTemplateRefs() *templateRefs {
+	return &templateRefs{names: make(map[string]string), defined: make(map[string]bool)}
+}
+
+// collectReferences records the defines and unresolved template tags of the
+// cached sources, t is the template they were parsed into
+func (l *loader) collectReferences(t engineTemplate, refs *templateRefs) {
+	for _, nt := range l.cache {
+		for _, m := range l.reDefineTag.FindAllStringSubmatch(nt.Src, -1) {
+			refs.defined[m[1]] = true
+		}
+		for _, m := range l.reTemplateTag.FindAllStringSubmatch(nt.Src, -1) {
+			if t.Defines(m[1]) {
+				continue
+			}
+			ref := fmt.Sprintf("%s: %q", nt.Path, m[1])
+			if _, ok := refs.names[ref]; !ok {
+				refs.unresolved = append(refs.unresolved, ref)
+				refs.names[ref] = m[1]
+			}
+		}
+	}
+}
+
+// dangling returns the unresolved tags whose name no loaded source defines
+// and that include no registered template, nil when all of them resolve
+func (refs *templateRefs) dangling(registered func(name string) bool) []string {
+	var dangling []string
+	for _, ref := range refs.unresolved {
+		if name := refs.names[ref]; !refs.defined[name] && !registered(name) {
+			dangling = append(dangling, ref)
+		}
+	}
+	return dangling
+}
+
+// templateKey returns the name the template at path is registered by. The
+// template itself keeps its file name, so includes by path still resolve.
+func (l *loader) templateKey(path string) string {
+	name := generateTemplateName(l.basePath, path)
+	if l.nameFunc != nil {
+		name = l.nameFunc(name)
+	}
+	if l.caseInsensitive {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// add adds the template file at path to the cache as tplName, together with
+// every template file it includes
+func (l *loader) add(tplName, path string) error {
 	// Get file content
-	tplSrc, err := file_content(path)
+	tplSrc, err := file_content(l.fsys, path, l.allowEmpty)
 	if err != nil {
 		return err
 	}
+	return l.addSource(tplName, path, tplSrc)
+}
 
-	tplName := generateTemplateName(basePath, path)
+// include adds an included template file. Files that can't be read are left
+// to fail when rendering, or to StrictPartials, but any other error is returned.
+func (l *loader) include(tplName, path string) error {
+	tplSrc, err := file_content(l.fsys, path, l.allowEmpty)
+	if err != nil {
+		return nil
+	}
+	return l.addSource(tplName, path, tplSrc)
+}
 
-	// Make sure template is not already included
+func (l *loader) addSource(tplName, path, tplSrc string) error {
+	// Make sure template is not already included. This also ends circular
+	// includes: a template is cached before its includes are followed, so an
+	// include leading back to it stops here. Templates including each other is
+	// fine to parse and common for recursive partials, a cycle without an
+	// exit fails when rendering with the template depth limit of the stdlib.
 	alreadyIncluded := false
-	for _, nt := range cache {
+	for _, nt := range l.cache {
 		if nt.Name == tplName {
 			alreadyIncluded = true
 			break
@@ -135,26 +528,96 @@ func add(path string) error {
 		return nil
 	}
 
-	// Add to the cache
+	if l.frontMatter {
+		meta, src, err := l.splitFrontMatter(tplSrc)
+		if err != nil {
+			return fmt.Errorf("render: %s: %w", path, err)
+		}
+		// only the front matter of the file being loaded describes the page
+		if len(l.cache) == 0 {
+			l.pageMeta = meta
+		}
+		tplSrc = src
+	}
+	if l.preprocess != nil {
+		var err error
+		if tplSrc, err = l.preprocess(tplName, tplSrc); err != nil {
+			return fmt.Errorf("render: preprocessing %s: %w", path, err)
+		}
+	}
+
+	// Add to the cache, before following the includes below
 	nt := &namedTemplate{
 		Name: tplName,
+		Path: path,
 		Src:  tplSrc,
 	}
-	cache = append(cache, nt)
+	l.cache = append(l.cache, nt)
 
 	// Check for any template block
-	for _, raw := range reTemplateTag.FindAllString(nt.Src, -1) {
-		parsed := reTemplateTag.FindStringSubmatch(raw)
+	var includeErr error
+	nt.Src = l.reTemplateTag.ReplaceAllStringFunc(nt.Src, func(raw string) string {
+		parsed := l.reTemplateTag.FindStringSubmatch(raw)
 		templatePath := parsed[1]
-		ext := filepath.Ext(templatePath)
-		if !strings.Contains(templatePath, ext) {
-			regularTemplateDefs = append(regularTemplateDefs, templatePath)
-			continue
+		if isGlob(templatePath) {
+			expanded, err := l.addGlob(raw, templatePath)
+			if err != nil && includeErr == nil {
+				includeErr = err
+			}
+			return expanded
+		}
+		// Names without a file extension are regular define names
+		if len(filepath.Ext(templatePath)) == 0 {
+			l.regularTemplateDefs = append(l.regularTemplateDefs, templatePath)
+			return raw
 		}
 
-		// Add this template and continue looking for more template blocks
-		add(filepath.Join(basePath, templatePath))
+		// Add this template and continue looking for more template blocks.
+		// A registered name resolves in whichever root it was found in.
+		p, ok := l.files[templatePath]
+		if !ok {
+			p = joinPath(l.fsys, l.basePath, templatePath)
+		}
+		if err := l.include(templatePath, p); err != nil && includeErr == nil {
+			includeErr = err
+		}
+		return raw
+	})
+
+	return includeErr
+}
+
+// addGlob adds every template matching pattern relative to basePath and
+// returns the template tag raw repeated once for each of them, in lexical order
+func (l *loader) addGlob(raw, pattern string) (string, error) {
+	var (
+		matches []string
+		err     error
+	)
+	if l.fsys != nil {
+		matches, err = fs.Glob(l.fsys, path.Join(l.basePath, pattern))
+	} else {
+		matches, err = filepath.Glob(filepath.Join(l.basePath, pattern))
+	}
+	if err != nil {
+		return raw, fmt.Errorf("render: template pattern %q: %w", pattern, err)
+	}
+	if len(matches) == 0 {
+		return raw, fmt.Errorf("render: template pattern %q matches no files", pattern)
 	}
 
-	return nil
+	var expanded strings.Builder
+	for i, match := range matches {
+		name := generateTemplateName(l.basePath, match)
+		if err := l.include(name, match); err != nil {
+			return raw, err
+		}
+		tag := strings.Replace(raw, `"`+pattern+`"`, `"`+name+`"`, 1)
+		if i < len(matches)-1 {
+			// keep the line count of the source so parse errors point at the right line
+			tag = strings.ReplaceAll(tag, "\n", " ")
+		}
+		expanded.WriteString(tag)
+	}
+	return expanded.String(), nil
 }
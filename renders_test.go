@@ -0,0 +1,215 @@
+package renders
+
+import (
+	"errors"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCircularIncludes(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{
+		"a.html":    `a{{ if . }}[{{ template "b.html" . }}]{{ end }}`,
+		"b.html":    `b{{ if gt . 1 }}[{{ template "a.html" dec . }}]{{ end }}`,
+		"loop.html": `{{ template "loop.html" }}`,
+	})
+	funcs := template.FuncMap{"dec": func(n int) int { return n - 1 }}
+	r, _ := testRenderer(t, Options{Directory: dir, Funcs: funcs})
+
+	tests := []struct {
+		name string
+		n    int
+		out  string
+	}{
+		{"a.html", 0, "a"},
+		{"a.html", 3, "a[b[a[b[a[b]]]]]"},
+		{"b.html", 2, "b[a[b]]"},
+	}
+	for _, test := range tests {
+		if out, err := r.HTMLString(test.name, test.n); err != nil || out != test.out {
+			t.Errorf("%s with %d: %q, %v, want %q", test.name, test.n, out, err, test.out)
+		}
+	}
+
+	// without an exit the depth limit of the template packages ends it
+	if _, err := r.HTMLString("loop.html", nil); err == nil || !strings.Contains(err.Error(), "depth") {
+		t.Errorf("loop.html: %v, want the maximum depth error", err)
+	}
+}
+
+func TestDirectoriesCrossReference(t *testing.T) {
+	a := writeTemplates(t, t.TempDir(), map[string]string{
+		"a.html":       `a[{{ template "b.html" . }}]`,
+		"c.html":       `c[{{ . }}]`,
+		"pages/p.html": `p[{{ template "shared/button.html" . }}]`,
+	})
+	b := writeTemplates(t, t.TempDir(), map[string]string{
+		"b.html":             `b[{{ template "c.html" . }}]`,
+		"shared/button.html": `button[{{ template "pages/label.html" . }}]`,
+		"pages/label.html":   `label`,
+	})
+
+	tests := []struct {
+		name, out string
+	}{
+		{"a.html", "a[b[c[x]]]"},
+		{"b.html", "b[c[x]]"},
+		{"pages/p.html", "p[button[label]]"},
+	}
+	for _, dirs := range [][]string{{a, b}, {b, a}} {
+		r, _ := testRenderer(t, Options{Directories: dirs, StrictPartials: true})
+		for _, test := range tests {
+			out, err := r.HTMLString(test.name, "x")
+			if err != nil {
+				t.Errorf("%s from %q: %v", test.name, dirs, err)
+			} else if out != test.out {
+				t.Errorf("%s from %q: %q, want %q", test.name, dirs, out, test.out)
+			}
+		}
+	}
+}
+
+func TestDefineTagRegexp(t *testing.T) {
+	tests := []struct {
+		src  string
+		name string
+	}{
+		{`{{define "x"}}`, "x"},
+		{`{{ define "x" }}`, "x"},
+		{`{{- define "x" -}}`, "x"},
+		{`{{-define "x"-}}`, "x"},
+		{"{{\tdefine\t\"x\"\t}}", "x"},
+		{"{{\n\tdefine\n\t\"x\"\n}}", "x"},
+		{"{{- \n define \"a/b.html\" \n -}}", "a/b.html"},
+		{`{{ define "" }}`, ""},
+		{`{{ template "x" }}`, "-"},
+		{`{{ defined "x" }}`, "-"},
+		{`{{ define x }}`, "-"},
+	}
+
+	re := defineTagRegexp(defaultLeftDelim, defaultRightDelim)
+	for _, test := range tests {
+		m := re.FindStringSubmatch(test.src)
+		switch {
+		case test.name == "-" && m != nil:
+			t.Errorf("%q: matched %q", test.src, m[1])
+		case test.name != "-" && m == nil:
+			t.Errorf("%q: no match", test.src)
+		case m != nil && m[1] != test.name:
+			t.Errorf("%q: name %q, want %q", test.src, m[1], test.name)
+		}
+	}
+}
+
+func TestTemplateTagRegexp(t *testing.T) {
+	tests := []struct {
+		src  string
+		name string
+	}{
+		{`{{template "x"}}`, "x"},
+		{`{{ template "x" . }}`, "x"},
+		{`{{- template "x" . -}}`, "x"},
+		{"{{\ttemplate\t\"x\"\t.Data\t}}", "x"},
+		{"{{\n\ttemplate \"x\"\n\t(dict \"a\" 1)\n}}", "x"},
+		{`{{ template "layouts/base.html" . }}`, "layouts/base.html"},
+		{`{{ define "x" }}`, "-"},
+		{`{{ templates "x" }}`, "-"},
+	}
+
+	re := templateTagRegexp(defaultLeftDelim, defaultRightDelim)
+	for _, test := range tests {
+		m := re.FindStringSubmatch(test.src)
+		switch {
+		case test.name == "-" && m != nil:
+			t.Errorf("%q: matched %q", test.src, m[1])
+		case test.name != "-" && m == nil:
+			t.Errorf("%q: no match", test.src)
+		case m != nil && m[1] != test.name:
+			t.Errorf("%q: name %q, want %q", test.src, m[1], test.name)
+		}
+	}
+}
+
+func TestTagRegexpDelims(t *testing.T) {
+	def := defineTagRegexp("[[", "]]")
+	if m := def.FindStringSubmatch(`[[- define "x" -]]`); m == nil || m[1] != "x" {
+		t.Errorf("define with [[ ]]: %q", m)
+	}
+	if def.MatchString(`{{ define "x" }}`) {
+		t.Error("define with [[ ]] matched {{ }}")
+	}
+	tpl := templateTagRegexp("[[", "]]")
+	if m := tpl.FindStringSubmatch(`[[ template "x" . ]]`); m == nil || m[1] != "x" {
+		t.Errorf("template with [[ ]]: %q", m)
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	base := writeTemplates(t, t.TempDir(), map[string]string{
+		"index.html":      `index`,
+		"shared/btn.html": `btn`,
+		"pages/page.html": `page`,
+	})
+	other := writeTemplates(t, t.TempDir(), map[string]string{
+		"x.html": `x`,
+	})
+	links := map[string]string{
+		// inside and outside the base
+		"alias": filepath.Join(base, "shared"),
+		"ext":   other,
+		// loops, directly and through the walk of ext
+		"pages/up":                   base,
+		filepath.Join(other, "back"): base,
+	}
+	for link, target := range links {
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(base, link)
+		}
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks unsupported: %v", err)
+		}
+	}
+
+	// whether name is loaded without and with FollowSymlinks
+	tests := []struct {
+		name    string
+		off, on bool
+	}{
+		{"index.html", true, true},
+		{"shared/btn.html", true, true},
+		{"pages/page.html", true, true},
+		{"alias/btn.html", false, true},
+		{"ext/x.html", false, true},
+		{"pages/up/index.html", false, false},
+		{"ext/back/index.html", false, false},
+	}
+	for _, follow := range []bool{false, true} {
+		r, _ := testRenderer(t, Options{Directory: base, FollowSymlinks: follow})
+		for _, test := range tests {
+			_, err := r.HTMLString(test.name, nil)
+			found := test.off
+			if follow {
+				found = test.on
+			}
+			switch {
+			case found && err != nil:
+				t.Errorf("FollowSymlinks %v: %s: %v", follow, test.name, err)
+			case !found && err == nil:
+				t.Errorf("FollowSymlinks %v: %s loaded", follow, test.name)
+			}
+		}
+	}
+}
+
+func TestLoadTextMode(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{"a.html": `a`})
+	opt := Options{Directory: dir, TextMode: true}
+	if m, err := Load(opt); !errors.Is(err, errLoadTextMode) || m != nil {
+		t.Errorf("Load: %d templates, %v", len(m), err)
+	}
+	if m, err := LoadWithFuncMap(opt); !errors.Is(err, errLoadTextMode) || m != nil {
+		t.Errorf("LoadWithFuncMap: %d templates, %v", len(m), err)
+	}
+}
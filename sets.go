@@ -0,0 +1,195 @@
+package renders
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// compiledTemplate keeps a parsed template that is never executed itself.
+// html/template refuses to Clone a template after it was executed, so renders
+// that need their own funcs clone the master while every other render shares
+// one executable copy of it.
+type compiledTemplate struct {
+	master engineTemplate
+	// front matter of the template file, nil without
+	meta map[string]interface{}
+
+	once sync.Once
+	exec engineTemplate
+	err  error
+}
+
+// executable returns the shared copy used by renders without extra funcs
+func (ct *compiledTemplate) executable() (engineTemplate, error) {
+	ct.once.Do(func() {
+		ct.exec, ct.err = ct.master.Clone()
+	})
+	return ct.exec, ct.err
+}
+
+// clone returns a private copy that may get its own funcs before executing
+func (ct *compiledTemplate) clone() (engineTemplate, error) {
+	return ct.master.Clone()
+}
+
+// templateSet holds the compiled templates of one set, keyed like the maps
+// returned by Load
+type templateSet map[string]*compiledTemplate
+
+func newTemplateSet(t map[string]engineTemplate) templateSet {
+	set := make(templateSet, len(t))
+	for name, tmpl := range t {
+		set[name] = &compiledTemplate{master: tmpl}
+	}
+	return set
+}
+
+// names returns the names of the templates in the set, sorted
+func (set templateSet) names() []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lazySet is a template set that may only be compiled on first use
+type lazySet struct {
+	once sync.Once
+	load func() (templateSet, error)
+	set  templateSet
+	err  error
+	// build compiles the set again from its directory, nil when it can't
+	build func() (templateSet, error)
+	// the default set of a Templates, as opposed to one added with
+	// SetTemplatePath
+	shared bool
+}
+
+func (ls *lazySet) templates() (templateSet, error) {
+	ls.once.Do(func() {
+		if ls.load != nil {
+			ls.set, ls.err = ls.load()
+			ls.load = nil
+		}
+	})
+	return ls.set, ls.err
+}
+
+// templateSets holds the template sets registered on a Renderer. It is shared
+// by the renderers of all requests, so sets added at runtime are seen by every
+// later request.
+type templateSets struct {
+	lock sync.RWMutex
+	sets map[string]*lazySet
+}
+
+func newTemplateSets() *templateSets {
+	return &templateSets{
+		sets: make(map[string]*lazySet),
+	}
+}
+
+// get returns the set registered as name, compiling a lazy set first. A lazy
+// set that failed to compile is returned as nil.
+func (ts *templateSets) get(name string) (templateSet, bool) {
+	ls, ok := ts.entry(name)
+	if !ok {
+		return nil, false
+	}
+	set, _ := ls.templates()
+	return set, true
+}
+
+// load is get with the error a lazy set failed to compile with, a missing
+// set is a nil set without error
+func (ts *templateSets) load(name string) (templateSet, error) {
+	ls, ok := ts.entry(name)
+	if !ok {
+		return nil, nil
+	}
+	return ls.templates()
+}
+
+func (ts *templateSets) entry(name string) (*lazySet, bool) {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+
+	ls, ok := ts.sets[name]
+	return ls, ok
+}
+
+// has reports whether a set is registered as name, without compiling it
+func (ts *templateSets) has(name string) bool {
+	_, ok := ts.entry(name)
+	return ok
+}
+
+func (ts *templateSets) set(name string, set templateSet) {
+	ts.add(name, set, nil)
+}
+
+// add registers a compiled set, build compiles it again for reload
+func (ts *templateSets) add(name string, set templateSet, build func() (templateSet, error)) {
+	ls := &lazySet{set: set, build: build}
+	ls.once.Do(func() {})
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.sets[name] = ls
+}
+
+// addShared registers the default set compiled by a Templates, unless the
+// handler replaced it with SetTemplatePath, whose set stays
+func (ts *templateSets) addShared(name string, set templateSet, build func() (templateSet, error)) {
+	ls := &lazySet{set: set, build: build, shared: true}
+	ls.once.Do(func() {})
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if old, ok := ts.sets[name]; ok && !old.shared {
+		return
+	}
+	ts.sets[name] = ls
+}
+
+// setLazy registers a set that build compiles once, when it is first used.
+// A failed build stays failed until the set is registered or reloaded again.
+func (ts *templateSets) setLazy(name string, build func() (templateSet, error)) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	ts.sets[name] = &lazySet{load: build, build: build}
+}
+
+// reload compiles the set registered as name again and swaps it in, renders
+// that already got the old set finish with it. Nothing is swapped when the
+// set fails to compile or was replaced while compiling.
+func (ts *templateSets) reload(name string) (templateSet, error) {
+	ls, ok := ts.entry(name)
+	if !ok {
+		return nil, fmt.Errorf("render: no template set %q", name)
+	}
+	if ls.build == nil {
+		return nil, fmt.Errorf("render: template set %q can't be reloaded", name)
+	}
+	set, err := ls.build()
+	if err != nil {
+		return nil, err
+	}
+
+	reloaded := &lazySet{set: set, build: ls.build, shared: ls.shared}
+	reloaded.once.Do(func() {})
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if ts.sets[name] == ls {
+		ts.sets[name] = reloaded
+	}
+	return set, nil
+}
@@ -0,0 +1,128 @@
+package renders
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"time"
+
+	"gopkg.in/macaron.v1"
+)
+
+const ContentEventStream = "text/event-stream"
+
+// Stream sends every value received from ch to the client as a server-sent
+// event with the JSON encoded value as data. It returns once ch is closed or
+// the request is cancelled. A ResponseWriter that can't flush gets the events
+// written all the same, the client then receives them whenever the writer
+// sends its buffer, at the latest when the handler returns.
+func (r *renderer) Stream(status int, ch <-chan interface{}) {
+	if r.opt.RecoverPanics {
+		defer r.recoverPanic(ContentEventStream, nil)
+	}
+	flush := r.flushFunc()
+	r.Header().Set(ContentType, ContentEventStream+r.compiledCharset)
+	r.Header().Set("Cache-Control", "no-cache")
+	r.Header().Set("Connection", "keep-alive")
+	r.WriteHeader(status)
+	flush()
+
+	done := r.req.Context().Done()
+	for {
+		select {
+		case <-done:
+			return
+		case v, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(v)
+			if err != nil {
+				// the status is long gone, all we can do is stop
+				if r.opt.Logger != nil {
+					r.opt.Logger.Printf("renders: streaming event: %v", err)
+				}
+				return
+			}
+			r.Write([]byte("data: "))
+			r.Write(data)
+			r.Write([]byte("\n\n"))
+			flush()
+		}
+	}
+}
+
+// HTMLStream renders the template name of the default set like HTML, except
+// that a {{ flush }} in the template sends everything rendered so far to the
+// client right away, e.g. the <head> of the page before its slow body, and
+// rendering continues into an empty buffer. With a layout, flush works in the
+// outermost layout only, everything yield renders is sent in one piece.
+//
+// The status and headers go out with the first flush, a later error can only
+// cut the response short. Flushed output is neither minified nor compressed
+// and carries no Content-Length or ETag. Without a flush the response is the
+// same as the one of HTML. A ResponseWriter that can't flush gets the output
+// written all the same, when the writer sends it is up to the writer.
+func (r *renderer) HTMLStream(status int, name string, data interface{}, htmlOpt ...macaron.HTMLOptions) {
+	var err error
+	defer r.timeRender(r.opt.HTMLContentType, status, name, time.Now(), &err)
+
+	if r.cancelled() {
+		err = r.req.Context().Err()
+		return
+	}
+
+	out := r.bufpool.Get()
+	defer r.bufpool.Put(out)
+
+	var flushWriter func()
+	sent := false
+	flush := func() (string, error) {
+		if r.cancelled() {
+			return "", r.req.Context().Err()
+		}
+		if !sent {
+			flushWriter = r.flushFunc()
+			r.Header().Set(ContentType, r.templateContentType(defaultTplSetName, name, ""))
+			r.setSecurityHeaders()
+			r.WriteHeader(status)
+			sent = true
+			if err := writeAll(r, [][]byte{r.byteOrderMark(r.Header().Get(ContentType))}); err != nil {
+				return "", err
+			}
+		}
+		if err := writeAll(r, [][]byte{out.Bytes()}); err != nil {
+			return "", err
+		}
+		out.Reset()
+		flushWriter()
+		return "", nil
+	}
+
+	err = r.renderTo(out, defaultTplSetName, name, data, nil, template.FuncMap{"flush": flush}, htmlOpt...)
+	switch {
+	case err != nil && !sent:
+		r.httpError(http.StatusInternalServerError, err.Error())
+	case err != nil:
+		// the status is long gone, all we can do is stop
+		if r.opt.Logger != nil {
+			r.opt.Logger.Printf("renders: streaming %s: %v", name, err)
+		}
+	case !sent:
+		err = r.writeHTML(status, name, r.templateContentType(defaultTplSetName, name, ""), out.Bytes())
+	default:
+		_, err = flush()
+	}
+}
+
+// flushFunc returns the Flush of the ResponseWriter, or a func doing nothing
+// when the writer can't flush
+func (r *renderer) flushFunc() func() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		return flusher.Flush
+	}
+	if r.opt.Logger != nil {
+		r.opt.Logger.Printf("renders: streaming to a %T that can't flush, output is buffered", r.ResponseWriter)
+	}
+	return func() {}
+}
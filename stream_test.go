@@ -0,0 +1,93 @@
+package renders
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// plainWriter is a ResponseWriter that can't flush, like some wrappers
+type plainWriter struct {
+	rec *httptest.ResponseRecorder
+}
+
+func (w plainWriter) Header() http.Header         { return w.rec.Header() }
+func (w plainWriter) Write(p []byte) (int, error) { return w.rec.Write(p) }
+func (w plainWriter) WriteHeader(status int)      { w.rec.WriteHeader(status) }
+
+func streamEvents(r *renderer) {
+	ch := make(chan interface{}, 2)
+	ch <- map[string]int{"n": 1}
+	ch <- "two"
+	close(ch)
+	r.Stream(http.StatusOK, ch)
+}
+
+func TestStream(t *testing.T) {
+	const want = "data: {\"n\":1}\n\ndata: \"two\"\n\n"
+
+	r, rec := testRenderer(t, Options{Directory: t.TempDir()})
+	streamEvents(r)
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("recorder: %d %q, want %q", rec.Code, rec.Body, want)
+	}
+	if !rec.Flushed {
+		t.Error("recorder: not flushed")
+	}
+	if ct := rec.Header().Get(ContentType); !strings.HasPrefix(ct, ContentEventStream) {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	var logs bytes.Buffer
+	r, rec = testRenderer(t, Options{Directory: t.TempDir(), Logger: log.New(&logs, "", 0)})
+	r.ResponseWriter = plainWriter{rec}
+	streamEvents(r)
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("non-flushing writer: %d %q, want %q", rec.Code, rec.Body, want)
+	}
+	if rec.Flushed {
+		t.Error("non-flushing writer: flushed")
+	}
+	if !strings.Contains(logs.String(), "can't flush") {
+		t.Errorf("non-flushing writer: logged %q", logs.String())
+	}
+}
+
+func TestHTMLStream(t *testing.T) {
+	dir := writeTemplates(t, t.TempDir(), map[string]string{
+		"page.html":  `<head>{{ flush }}<body>{{ .Name }}</body>`,
+		"plain.html": `<p>{{ .Name }}</p>`,
+	})
+	data := map[string]string{"Name": "gopher"}
+
+	tests := []struct {
+		name, out string
+		flushed   bool
+	}{
+		{"page.html", "<head><body>gopher</body>", true},
+		{"plain.html", "<p>gopher</p>", false},
+	}
+	for _, test := range tests {
+		r, rec := testRenderer(t, Options{Directory: dir})
+		r.HTMLStream(http.StatusCreated, test.name, data)
+		if rec.Code != http.StatusCreated || rec.Body.String() != test.out {
+			t.Errorf("%s to a recorder: %d %q, want %q", test.name, rec.Code, rec.Body, test.out)
+		}
+		if rec.Flushed != test.flushed {
+			t.Errorf("%s to a recorder: flushed %v", test.name, rec.Flushed)
+		}
+
+		r, rec = testRenderer(t, Options{Directory: dir})
+		r.ResponseWriter = plainWriter{rec}
+		r.HTMLStream(http.StatusCreated, test.name, data)
+		if rec.Code != http.StatusCreated || rec.Body.String() != test.out {
+			t.Errorf("%s to a non-flushing writer: %d %q, want %q", test.name, rec.Code, rec.Body, test.out)
+		}
+		if rec.Flushed {
+			t.Errorf("%s to a non-flushing writer: flushed", test.name)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package renders
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// HTMLTable writes v as an HTML table, meant for debug and admin pages that
+// don't deserve a template. v is a slice of structs or of maps, or a single
+// one of them: exported struct fields or map keys make the header row, every
+// element a row. Values that aren't strings are written with fmt.Sprint.
+func (r *renderer) HTMLTable(status int, v interface{}) {
+	body, err := htmlTable(v)
+	if err != nil {
+		r.httpError(http.StatusInternalServerError, err.Error())
+		return
+	}
+	r.writeHTML(status, "", r.htmlContentType(""), body)
+}
+
+func htmlTable(v interface{}) ([]byte, error) {
+	rv := indirect(reflect.ValueOf(v))
+	var rows []reflect.Value
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			rows = append(rows, indirect(rv.Index(i)))
+		}
+	case reflect.Struct, reflect.Map:
+		rows = []reflect.Value{rv}
+	default:
+		return nil, fmt.Errorf("render: HTMLTable needs a slice of structs or maps, got %T", v)
+	}
+
+	columns, err := tableColumns(rv, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("<table>\n<thead><tr>")
+	for _, c := range columns {
+		buf.WriteString("<th>" + html.EscapeString(c) + "</th>")
+	}
+	buf.WriteString("</tr></thead>\n<tbody>\n")
+	for _, row := range rows {
+		buf.WriteString("<tr>")
+		for _, c := range columns {
+			buf.WriteString("<td>" + html.EscapeString(tableCell(row, c)) + "</td>")
+		}
+		buf.WriteString("</tr>\n")
+	}
+	buf.WriteString("</tbody>\n</table>\n")
+	return buf.Bytes(), nil
+}
+
+// tableColumns returns the exported fields of the struct elements in order,
+// or the sorted keys of all map elements
+func tableColumns(rv reflect.Value, rows []reflect.Value) ([]string, error) {
+	elem := rv.Type()
+	if k := elem.Kind(); k == reflect.Slice || k == reflect.Array {
+		elem = elem.Elem()
+	}
+	for elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	if elem.Kind() == reflect.Interface {
+		// the elements say what they are
+		for _, row := range rows {
+			if row.IsValid() {
+				elem = row.Type()
+				break
+			}
+		}
+	}
+
+	switch elem.Kind() {
+	case reflect.Struct:
+		var columns []string
+		for i := 0; i < elem.NumField(); i++ {
+			if f := elem.Field(i); len(f.PkgPath) == 0 {
+				columns = append(columns, f.Name)
+			}
+		}
+		return columns, nil
+	case reflect.Map:
+		seen := make(map[string]bool)
+		var columns []string
+		for _, row := range rows {
+			if row.Kind() != reflect.Map {
+				continue
+			}
+			for _, k := range row.MapKeys() {
+				if key := fmt.Sprint(k.Interface()); !seen[key] {
+					seen[key] = true
+					columns = append(columns, key)
+				}
+			}
+		}
+		sort.Strings(columns)
+		return columns, nil
+	}
+	return nil, fmt.Errorf("render: HTMLTable needs a slice of structs or maps, got %s", rv.Type())
+}
+
+// tableCell returns the value of column in row, empty when row has none
+func tableCell(row reflect.Value, column string) string {
+	var v reflect.Value
+	switch row.Kind() {
+	case reflect.Struct:
+		v = row.FieldByName(column)
+	case reflect.Map:
+		for _, k := range row.MapKeys() {
+			if fmt.Sprint(k.Interface()) == column {
+				v = row.MapIndex(k)
+				break
+			}
+		}
+	}
+	if !v.IsValid() {
+		return ""
+	}
+	if v = indirect(v); !v.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// indirect follows pointers and interfaces, a nil one gives the zero Value
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
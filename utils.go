@@ -1,35 +1,130 @@
 package renders
 
 import (
-	"errors"
+	"fmt"
+	"io/fs"
 	"io/ioutil"
+	"path"
 	"path/filepath"
+	"strings"
 )
 
+// generateTemplateName returns the slash separated name of the template at
+// path relative to base. base may be "." or end in a separator, a path that
+// can't be made relative to base keeps its own name.
 func generateTemplateName(base, path string) string {
-	return filepath.ToSlash(path[len(base)+1:])
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return filepath.ToSlash(filepath.Clean(path))
+	}
+	if rel == "." {
+		// base is the template file itself
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// localizedName returns the name of the locale variant of a template, the
+// locale goes before the extension: "home.html" becomes "home.fr.html"
+func localizedName(name, locale string) string {
+	ext := path.Ext(name)
+	return name[:len(name)-len(ext)] + "." + locale + ext
 }
 
-func file_content(path string) (string, error) {
+// file_content reads the template at path from fsys, or from the disk when
+// fsys is nil. An empty file is an error unless allowEmpty is set.
+func file_content(fsys fs.FS, path string, allowEmpty bool) (string, error) {
+	var (
+		b   []byte
+		err error
+	)
 	// Read the file content of the template
-	b, err := ioutil.ReadFile(path)
+	if fsys != nil {
+		b, err = fs.ReadFile(fsys, path)
+	} else {
+		b, err = ioutil.ReadFile(path)
+	}
 	if err != nil {
 		return "", err
 	}
 	s := string(b)
 
-	if len(s) < 1 {
-		return "", errors.New("render: template file is empty")
+	if len(s) < 1 && !allowEmpty {
+		return "", fmt.Errorf("render: template file %s is empty", path)
 	}
 
 	return s, nil
 }
 
-func inExtensions(ext string) bool {
-	for _, e := range exts {
-		if e == ext {
+// joinPath joins path elements with the separator fsys expects, fs.FS paths
+// are always slash separated while the disk uses the OS separator
+func joinPath(fsys fs.FS, elem ...string) string {
+	if fsys != nil {
+		return path.Join(elem...)
+	}
+	return filepath.Join(elem...)
+}
+
+// isGlob reports whether a template path has glob metacharacters
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// lessPath orders slash separated paths element by element, so the files of
+// a directory stay together, like a depth-first walk in lexical order
+func lessPath(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// withinDir reports whether path is dir or inside of it
+func withinDir(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+func anyWithinDir(paths []string, dir string) bool {
+	for _, p := range paths {
+		if withinDir(p, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareExtensions returns exts with a leading dot added where it is
+// missing, DefaultExtensions when exts is empty. An extension that can't be
+// one of a file name, like "" or ".", is an error.
+func prepareExtensions(exts []string) ([]string, error) {
+	if len(exts) == 0 {
+		exts = DefaultExtensions
+	}
+	prepared := make([]string, len(exts))
+	for i, ext := range exts {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if len(ext) == 1 || strings.ContainsAny(ext[1:], `./\ `) {
+			return nil, fmt.Errorf("render: invalid template extension %q", exts[i])
+		}
+		prepared[i] = ext
+	}
+	return prepared, nil
+}
+
+func inExtensions(exts []string, ext string) bool {
+	return containsString(exts, ext)
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
 			return true
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
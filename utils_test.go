@@ -0,0 +1,32 @@
+package renders
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateTemplateName(t *testing.T) {
+	abs, err := filepath.Abs("templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		base, path, name string
+	}{
+		{"templates", "templates/users/index.html", "users/index.html"},
+		{"templates/", "templates/users/index.html", "users/index.html"},
+		{"templates" + string(filepath.Separator), filepath.Join("templates", "a.html"), "a.html"},
+		{"./templates", "templates/a.html", "a.html"},
+		{".", "users/index.html", "users/index.html"},
+		{".", "./a.html", "a.html"},
+		{abs, filepath.Join(abs, "users", "index.html"), "users/index.html"},
+		{abs + string(filepath.Separator), filepath.Join(abs, "a.html"), "a.html"},
+		{"templates/a.html", "templates/a.html", "a.html"},
+	}
+	for _, test := range tests {
+		if name := generateTemplateName(test.base, test.path); name != test.name {
+			t.Errorf("generateTemplateName(%q, %q) = %q, want %q", test.base, test.path, name, test.name)
+		}
+	}
+}
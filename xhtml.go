@@ -0,0 +1,102 @@
+package renders
+
+import (
+	"bytes"
+	"strings"
+)
+
+// HTML void elements, which XHTML requires to be self-closed
+var voidElements = [][]byte{
+	[]byte("area"),
+	[]byte("base"),
+	[]byte("br"),
+	[]byte("col"),
+	[]byte("embed"),
+	[]byte("hr"),
+	[]byte("img"),
+	[]byte("input"),
+	[]byte("link"),
+	[]byte("meta"),
+	[]byte("param"),
+	[]byte("source"),
+	[]byte("track"),
+	[]byte("wbr"),
+}
+
+// isXHTML reports whether a Content-Type is XHTML
+func isXHTML(contentType string) bool {
+	return strings.HasPrefix(contentType, ContentXHTML)
+}
+
+// selfCloseVoidElements turns void elements like <br> into <br />, leaving
+// the content of pre, textarea, script and style elements alone
+func selfCloseVoidElements(src []byte) []byte {
+	out := make([]byte, 0, len(src)+len(src)/32)
+	for i := 0; i < len(src); {
+		if src[i] != '<' {
+			out = append(out, src[i])
+			i++
+			continue
+		}
+		if name := rawElement(src[i+1:]); name != nil {
+			end := indexFold(src[i:], append([]byte("</"), name...))
+			if end < 0 {
+				return append(out, src[i:]...)
+			}
+			out = append(out, src[i:i+end]...)
+			i += end
+			continue
+		}
+		if !isVoidElement(src[i+1:]) {
+			out = append(out, '<')
+			i++
+			continue
+		}
+
+		end := tagEnd(src[i:])
+		if end < 0 {
+			return append(out, src[i:]...)
+		}
+		tag := src[i : i+end]
+		if bytes.HasSuffix(tag, []byte("/")) {
+			out = append(out, tag...)
+		} else {
+			out = append(append(out, bytes.TrimRight(tag, " \t\r\n\f")...), " /"...)
+		}
+		out = append(out, '>')
+		i += end + 1
+	}
+	return out
+}
+
+// isVoidElement reports whether a tag starts with a void element name
+func isVoidElement(tag []byte) bool {
+	for _, name := range voidElements {
+		if len(tag) <= len(name) || !bytes.EqualFold(tag[:len(name)], name) {
+			continue
+		}
+		if next := tag[len(name)]; next == '>' || next == '/' || isSpace(next) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagEnd returns the index of the > closing the tag at the start of src,
+// skipping quoted attribute values, or -1 when the tag isn't closed
+func tagEnd(src []byte) int {
+	var quote byte
+	for i, c := range src {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i
+		}
+	}
+	return -1
+}